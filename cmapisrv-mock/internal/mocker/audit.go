@@ -0,0 +1,241 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	nodeStore "github.com/cilium/cilium/pkg/node/store"
+)
+
+const (
+	// auditSettleTimeout is the maximum time the audit waits for the in-flight
+	// operations to complete, before reporting the differences.
+	auditSettleTimeout = 5 * time.Second
+	auditRetryInterval = 100 * time.Millisecond
+)
+
+// auditResource describes how to retrieve the objects of a given resource type
+// which the mocker believes to have written to the kvstore.
+type auditResource struct {
+	typ string
+	// prefix returns the prefix matching all the keys of the given cluster.
+	prefix func(cl *cluster) string
+	// expected returns the expected absolute keys and values, given the
+	// prefix associated with the resource type.
+	expected func(cl *cluster, prefix string) (map[string][]byte, error)
+}
+
+var auditResources = []auditResource{
+	{
+		typ: "nodes",
+		prefix: func(cl *cluster) string {
+			return kvstore.JoinKey(cl.layout.prefix(nodeStore.NodeStorePrefix), cl.cinfo.Name)
+		},
+		expected: func(cl *cluster, _ string) (map[string][]byte, error) {
+			// The node keys already include the cluster name.
+			return snapshot(&cl.nodes.cache, cl.layout.prefix(nodeStore.NodeStorePrefix))
+		},
+	},
+	{
+		typ:    "identities",
+		prefix: func(cl *cluster) string { return cl.layout.identities(cl.cinfo.Name) },
+		expected: func(cl *cluster, prefix string) (map[string][]byte, error) {
+			return snapshot(&cl.identities.cache, prefix)
+		},
+	},
+	{
+		typ:    "ips",
+		prefix: func(cl *cluster) string { return cl.layout.endpoints(cl.cinfo.Name) },
+		expected: func(cl *cluster, prefix string) (map[string][]byte, error) {
+			return snapshot(&cl.endpoints.cache, prefix)
+		},
+	},
+	{
+		typ: "services",
+		prefix: func(cl *cluster) string {
+			return kvstore.JoinKey(cl.layout.prefix(serviceStore.ServiceStorePrefix), cl.cinfo.Name)
+		},
+		expected: func(cl *cluster, _ string) (map[string][]byte, error) {
+			// The service keys already include the cluster name.
+			return snapshot(&cl.services.cache, cl.layout.prefix(serviceStore.ServiceStorePrefix))
+		},
+	},
+	{
+		typ: "serviceexports",
+		prefix: func(cl *cluster) string {
+			return kvstore.JoinKey(cl.layout.prefix(ServiceExportStorePrefix), cl.cinfo.Name)
+		},
+		expected: func(cl *cluster, _ string) (map[string][]byte, error) {
+			// The service export keys already include the cluster name.
+			return snapshot(&cl.exports.cache, cl.layout.prefix(ServiceExportStorePrefix))
+		},
+	},
+}
+
+// snapshot returns the marshaled representation of all values in the cache,
+// indexed by the corresponding absolute key.
+func snapshot[T store.Key](c *cache[T], prefix string) (map[string][]byte, error) {
+	out := make(map[string][]byte)
+	for _, value := range c.Select(func(T) bool { return true }) {
+		data, err := value.Marshal()
+		if err != nil {
+			return nil, fmt.Errorf("marshaling %q: %w", value.GetKeyName(), err)
+		}
+
+		out[kvstore.JoinKey(prefix, value.GetKeyName())] = data
+	}
+
+	return out, nil
+}
+
+type clusterAudit struct {
+	Name       string                   `json:"name"`
+	Consistent bool                     `json:"consistent"`
+	Resources  map[string]resourceAudit `json:"resources,omitempty"`
+}
+
+type resourceAudit struct {
+	// Expected is the number of objects the mocker believes to have written.
+	Expected int `json:"expected"`
+	// Actual is the number of objects found in the kvstore.
+	Actual int `json:"actual"`
+	// Missing are the keys expected, but not found in the kvstore.
+	Missing []string `json:"missing,omitempty"`
+	// Extra are the keys found in the kvstore, but not expected.
+	Extra []string `json:"extra,omitempty"`
+	// Divergent are the keys whose value differs from the expected one.
+	Divergent []string `json:"divergent,omitempty"`
+}
+
+func (ra resourceAudit) consistent() bool {
+	return len(ra.Missing) == 0 && len(ra.Extra) == 0 && len(ra.Divergent) == 0
+}
+
+// audit compares the content of the kvstore with the objects the mocker
+// believes to have written for the given cluster. Clusters replaying a
+// recording are not audited, as the replayed objects are not tracked.
+func (cl *cluster) audit(ctx context.Context, typ string) (clusterAudit, error) {
+	report := clusterAudit{Name: cl.cinfo.Name, Consistent: true}
+	if cl.replay != nil {
+		return report, nil
+	}
+
+	report.Resources = make(map[string]resourceAudit)
+	for _, res := range auditResources {
+		if typ != "" && typ != res.typ {
+			continue
+		}
+
+		prefix := res.prefix(cl)
+		expected, err := res.expected(cl, prefix)
+		if err != nil {
+			return report, err
+		}
+
+		// Make sure to append the trailing slash, to prevent matching
+		// the keys of clusters whose name starts with the same prefix.
+		actual, err := cl.backend.ListPrefix(ctx, prefix+"/")
+		if err != nil {
+			return report, fmt.Errorf("listing %s: %w", res.typ, err)
+		}
+
+		ra := resourceAudit{Expected: len(expected), Actual: len(actual)}
+		for key, value := range expected {
+			switch kv, ok := actual[key]; {
+			case !ok:
+				ra.Missing = append(ra.Missing, key)
+			case !bytes.Equal(kv.Data, value):
+				ra.Divergent = append(ra.Divergent, key)
+			}
+		}
+
+		for key := range actual {
+			if _, ok := expected[key]; !ok {
+				ra.Extra = append(ra.Extra, key)
+			}
+		}
+
+		slices.Sort(ra.Missing)
+		slices.Sort(ra.Extra)
+		slices.Sort(ra.Divergent)
+
+		report.Resources[res.typ] = ra
+		report.Consistent = report.Consistent && ra.consistent()
+	}
+
+	return report, nil
+}
+
+// settledAudit audits the given cluster, retrying until the content of the
+// kvstore converges to the mocker's model, or the settle timeout expires. The
+// churn must be already held, so that the in-flight operations can complete.
+func (cl *cluster) settledAudit(ctx context.Context, typ string, deadline time.Time) (clusterAudit, error) {
+	for {
+		report, err := cl.audit(ctx, typ)
+		if err != nil || report.Consistent || time.Now().After(deadline) {
+			return report, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return report, ctx.Err()
+		case <-time.After(auditRetryInterval):
+		}
+	}
+}
+
+// audit handles the requests to compare the content of the kvstore with the
+// mocker's model, optionally restricted to the given cluster and type. The
+// churn of the audited clusters is held for the duration of the audit, so
+// that the operations still in-flight are not reported as differences.
+func (mk *mocker) audit(w http.ResponseWriter, r *http.Request) {
+	var (
+		name    = r.URL.Query().Get("cluster")
+		typ     = r.URL.Query().Get("type")
+		reports []clusterAudit
+	)
+
+	if typ != "" && !slices.ContainsFunc(auditResources, func(res auditResource) bool { return res.typ == typ }) {
+		mk.reply(w, r, http.StatusBadRequest, fmt.Sprintf("unknown type %q; must be one of %s", typ, strings.Join(resourceTypes, "|")))
+		return
+	}
+
+	var audited []*cluster
+	for _, cl := range mk.cls.list() {
+		if name == "" || name == cl.cinfo.Name {
+			audited = append(audited, cl)
+			defer cl.hold()()
+		}
+	}
+
+	deadline := time.Now().Add(auditSettleTimeout)
+	for _, cl := range audited {
+		report, err := cl.settledAudit(r.Context(), typ, deadline)
+		if err != nil {
+			mk.log.Error("Failed to audit cluster", logfields.ClusterName, cl.cinfo.Name, logfields.Error, err)
+			mk.reply(w, r, http.StatusInternalServerError, fmt.Sprintf("cluster %q: %s", cl.cinfo.Name, err))
+			return
+		}
+
+		reports = append(reports, report)
+	}
+
+	if len(reports) == 0 {
+		mk.reply(w, r, http.StatusNotFound, fmt.Sprintf("cluster %q not found", name))
+		return
+	}
+
+	mk.reply(w, r, http.StatusOK, reports)
+}
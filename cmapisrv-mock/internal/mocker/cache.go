@@ -9,28 +9,48 @@ import (
 )
 
 type cache[T store.Key] struct {
-	mu     lock.RWMutex
-	keys   map[string]int
-	values []T
+	mu      lock.RWMutex
+	keys    map[string]int
+	entries []entry[T]
+
+	// codec, if set, converts the cached values to a compact representation,
+	// which is decoded on demand, trading CPU time for memory.
+	codec codec[T]
+}
+
+// entry holds either the value itself, or its compact representation.
+type entry[T store.Key] struct {
+	value  T
+	packed string
 }
 
 func newCache[T store.Key]() cache[T] {
 	return cache[T]{keys: make(map[string]int)}
 }
 
-func (c *cache[T]) Get(rnd *random) T {
+// newCompactCache returns a cache storing the values through the given codec,
+// or a regular one if the codec is nil.
+func newCompactCache[T store.Key](cd codec[T]) cache[T] {
+	return cache[T]{keys: make(map[string]int), codec: cd}
+}
+
+// Get returns a random value, if the cache is not empty.
+func (c *cache[T]) Get(rnd *random) (value T, ok bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	id := rnd.Index(len(c.values))
-	return c.values[id]
+	if len(c.entries) == 0 {
+		return value, false
+	}
+
+	return c.at(rnd.Index(len(c.entries))), true
 }
 
 func (c *cache[T]) Len() uint {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	return uint(len(c.values))
+	return uint(len(c.entries))
 }
 
 func (c *cache[T]) Add(value T) bool {
@@ -45,13 +65,106 @@ func (c *cache[T]) Remove(rnd *random) T {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	id := rnd.Index(len(c.values))
-	value := c.values[id]
+	return c.removeAt(rnd.Index(len(c.entries)))
+}
+
+// Delete removes the value with the given key, if present.
+func (c *cache[T]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if id, ok := c.keys[key]; ok {
+		c.removeAt(id)
+	}
+}
+
+// Lookup returns the value with the given key, if present.
+func (c *cache[T]) Lookup(key string) (value T, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if id, ok := c.keys[key]; ok {
+		return c.at(id), true
+	}
+
+	return value, false
+}
+
+// Select returns all values matching the given predicate.
+func (c *cache[T]) Select(fn func(T) bool) []T {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var out []T
+	for id := range c.entries {
+		if value := c.at(id); fn(value) {
+			out = append(out, value)
+		}
+	}
+
+	return out
+}
+
+// Sample returns up to n distinct random values.
+func (c *cache[T]) Sample(rnd *random, n uint) []T {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if n >= uint(len(c.entries)) {
+		out := make([]T, 0, len(c.entries))
+		for id := range c.entries {
+			out = append(out, c.at(id))
+		}
+		return out
+	}
+
+	picked := make(map[int]struct{}, n)
+	out := make([]T, 0, n)
+	for uint(len(out)) < n {
+		id := rnd.Index(len(c.entries))
+		if _, ok := picked[id]; !ok {
+			picked[id] = struct{}{}
+			out = append(out, c.at(id))
+		}
+	}
+
+	return out
+}
+
+// at returns the value with the given index, decoding it if necessary.
+func (c *cache[T]) at(id int) T {
+	e := c.entries[id]
+	if c.codec == nil || e.packed == "" {
+		return e.value
+	}
+
+	return c.codec.decode(e.packed)
+}
+
+// pack returns the entry associated with the given value, converting it to the
+// compact representation if the codec is set, and it can encode the value.
+func (c *cache[T]) pack(value T) entry[T] {
+	if c.codec == nil {
+		return entry[T]{value: value}
+	}
 
-	c.values[id] = c.values[len(c.values)-1]
-	c.keys[c.values[id].GetKeyName()] = id
+	if packed, ok := c.codec.encode(value); ok && packed != "" {
+		return entry[T]{packed: packed}
+	}
+
+	return entry[T]{value: value}
+}
+
+func (c *cache[T]) removeAt(id int) T {
+	value, last := c.at(id), len(c.entries)-1
+
+	if id != last {
+		c.entries[id] = c.entries[last]
+		c.keys[c.at(id).GetKeyName()] = id
+	}
 
-	c.values = c.values[:len(c.values)-1]
+	c.entries[last] = entry[T]{}
+	c.entries = c.entries[:last]
 	delete(c.keys, value.GetKeyName())
 
 	return value
@@ -64,13 +177,13 @@ func (c *cache[T]) upsert(value T, overwrite bool) (stored bool) {
 	key := value.GetKeyName()
 	if idx, ok := c.keys[key]; ok {
 		if overwrite {
-			c.values[idx] = value
+			c.entries[idx] = c.pack(value)
 		}
 
 		return overwrite
 	}
 
-	c.keys[key] = len(c.values)
-	c.values = append(c.values, value)
+	c.keys[key] = len(c.entries)
+	c.entries = append(c.entries, c.pack(value))
 	return true
 }
@@ -0,0 +1,242 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"slices"
+	"testing"
+
+	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
+	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	nodeTypes "github.com/cilium/cilium/pkg/node/types"
+)
+
+func newTestRandom(t testing.TB) *random {
+	t.Helper()
+
+	cfg := defaultRndcfg
+	cfg.Seed = 42
+
+	rnd, err := newRandom(slog.New(slog.DiscardHandler), cfg)
+	if err != nil {
+		t.Fatalf("Failed to initialize random source: %v", err)
+	}
+	return rnd
+}
+
+func keys(values []*store.KVPair) []string {
+	var out []string
+	for _, value := range values {
+		out = append(out, value.Key)
+	}
+
+	slices.Sort(out)
+	return out
+}
+
+func TestCache(t *testing.T) {
+	var (
+		rnd = newTestRandom(t)
+		c   = newCache[*store.KVPair]()
+		all = func(*store.KVPair) bool { return true }
+	)
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if !c.Add(store.NewKVPair(key, "1")) {
+			t.Fatalf("Failed to add key %q", key)
+		}
+	}
+
+	if c.Add(store.NewKVPair("a", "2")) {
+		t.Fatal("Add unexpectedly overwrote an existing key")
+	}
+
+	c.Upsert(store.NewKVPair("b", "2"))
+	if value, ok := c.Lookup("b"); !ok || string(value.Value) != "2" {
+		t.Fatalf("Upsert did not overwrite the existing key, got %v", value)
+	}
+
+	if c.Len() != 4 {
+		t.Fatalf("Unexpected length, expected 4, got %d", c.Len())
+	}
+
+	c.Delete("a")
+	c.Delete("non-existing")
+	if got := keys(c.Select(all)); !slices.Equal(got, []string{"b", "c", "d"}) {
+		t.Fatalf("Unexpected keys after deletion: %v", got)
+	}
+
+	// The moved value must still be reachable through its key.
+	if _, ok := c.Lookup("d"); !ok {
+		t.Fatal("Failed to lookup key after deletion of a different one")
+	}
+
+	if got := keys(c.Select(func(kv *store.KVPair) bool { return string(kv.Value) == "1" })); !slices.Equal(got, []string{"c", "d"}) {
+		t.Fatalf("Unexpected selected keys: %v", got)
+	}
+
+	if got := c.Sample(rnd, 2); len(got) != 2 || got[0].Key == got[1].Key {
+		t.Fatalf("Sample did not return two distinct values: %v", keys(got))
+	}
+
+	if got := keys(c.Sample(rnd, 10)); !slices.Equal(got, []string{"b", "c", "d"}) {
+		t.Fatalf("Sample did not return all values: %v", got)
+	}
+
+	removed := c.Remove(rnd)
+	if _, ok := c.Lookup(removed.Key); ok || c.Len() != 2 {
+		t.Fatalf("Remove did not remove key %q", removed.Key)
+	}
+
+	for c.Len() > 0 {
+		c.Remove(rnd)
+	}
+
+	if _, ok := c.Get(rnd); ok {
+		t.Fatal("Get returned a value from an empty cache")
+	}
+
+	if c.Add(store.NewKVPair("a", "3")); c.Len() != 1 {
+		t.Fatal("Failed to add key after emptying the cache")
+	}
+}
+
+// newTestGenerators returns the nodes, endpoints and services of a dual-stack
+// cluster with WireGuard encryption, which are not running, to generate objects.
+func newTestGenerators(tb testing.TB, compact bool) (*nodes, *endpoints, *services) {
+	tb.Helper()
+
+	var (
+		log  = slog.New(slog.DiscardHandler)
+		rnd  = newTestRandom(tb)
+		spec = defaultConfig.clusterSpec(1, "cluster-001")
+	)
+
+	cp := cparams{
+		cluster:         cmtypes.ClusterInfo{ID: spec.ID, Name: spec.Name},
+		spec:            spec,
+		factory:         store.NewFactory(log, store.MetricsProvider()),
+		rnd:             rnd,
+		slots:           1,
+		family:          ipFamilyDual,
+		encryption:      encryptionModeWireGuard,
+		encryptionKey:   newEncryptionKey(encryptionModeWireGuard),
+		nodeAnnotations: map[string]string{"foo": "bar"},
+		metrics:         newMetrics(),
+		compactCache:    compact,
+		namespaces:      rnd.Pool("namespaces", spec.IdentityShape.Namespaces),
+		serviceAccounts: rnd.Pool("serviceaccounts", spec.IdentityShape.ServiceAccounts),
+	}
+
+	ns, ids := newNodes(log, cp), newIdentities(log, cp)
+	for range 10 {
+		ns.cache.Add(ns.new())
+	}
+	for range 10 {
+		ids.cache.Add(ids.new(ids.rnd.Identity(cp.cluster)))
+	}
+
+	return ns, newEndpoints(log, cp, ns, ids), newServices(log, cp)
+}
+
+func testCodec[T store.Key](t *testing.T, c *cache[T], gen func() T, tweak func(T) T) {
+	t.Helper()
+
+	initial := c.Len()
+	for range 100 {
+		value := gen()
+		c.Add(value)
+
+		got, ok := c.Lookup(value.GetKeyName())
+		if !ok || mustMarshal(t, got) != mustMarshal(t, value) {
+			t.Fatalf("Value not preserved by the codec, expected %+v, got %+v", value, got)
+		}
+	}
+
+	if idx := slices.IndexFunc(c.entries, func(e entry[T]) bool { return e.packed == "" }); idx != -1 {
+		t.Fatalf("Generated value unexpectedly not encoded: %+v", c.entries[idx].value)
+	}
+
+	// Values not preserved by the codec are stored as they are.
+	value := tweak(gen())
+	c.Upsert(value)
+	if got, _ := c.Lookup(value.GetKeyName()); mustMarshal(t, got) != mustMarshal(t, value) || c.entries[c.keys[value.GetKeyName()]].packed != "" {
+		t.Fatalf("Value not preserved by the fallback, expected %+v, got %+v", value, got)
+	}
+
+	// The key of the value moved in place of the deleted one gets updated.
+	c.Delete(c.at(0).GetKeyName())
+	if _, ok := c.Lookup(value.GetKeyName()); !ok || c.Len() != initial+100 {
+		t.Fatalf("Unexpected cache content after deletion: %d values", c.Len())
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	ns, eps, svc := newTestGenerators(t, true)
+
+	testCodec(t, &ns.cache, ns.new, func(no *nodeTypes.Node) *nodeTypes.Node {
+		no.Labels["extra"] = "label"
+		return no
+	})
+	testCodec(t, &eps.cache, newTestEndpoint(eps), func(ep *identity.IPIdentityPair) *identity.IPIdentityPair {
+		ep.Metadata = "metadata"
+		return ep
+	})
+	testCodec(t, &svc.cache, svc.new, func(cs *serviceStore.ClusterService) *serviceStore.ClusterService {
+		cs.Hostnames = map[string]string{"10.0.0.1": "foo"}
+		return cs
+	})
+}
+
+// newTestEndpoint returns a generator of endpoints hosted on random nodes.
+func newTestEndpoint(eps *endpoints) func() *identity.IPIdentityPair {
+	return func() *identity.IPIdentityPair { return eps.new(eps.nodeIPGetter()) }
+}
+
+// heapInUse returns the number of bytes currently allocated on the heap,
+// following a garbage collection.
+func heapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// benchmarkCache reports the memory cost of each object stored in the cache,
+// including the key, and the time required to retrieve a random one.
+func benchmarkCache[T store.Key](b *testing.B, c *cache[T], gen func() T) {
+	const objects = 10000
+
+	rnd := newTestRandom(b)
+	before := heapInUse()
+	for range objects {
+		c.Add(gen())
+	}
+
+	perObject := float64(heapInUse()-before) / objects
+
+	for b.Loop() {
+		_, _ = c.Get(rnd)
+	}
+
+	b.ReportMetric(perObject, "B/object")
+}
+
+// BenchmarkCache compares the regular and the compact cache. Run with:
+// go test -run=^$ -bench=BenchmarkCache ./internal/mocker
+func BenchmarkCache(b *testing.B) {
+	for _, compact := range []bool{false, true} {
+		b.Run(fmt.Sprintf("compact=%t", compact), func(b *testing.B) {
+			ns, eps, svc := newTestGenerators(b, compact)
+			b.Run("nodes", func(b *testing.B) { benchmarkCache(b, &ns.cache, ns.new) })
+			b.Run("endpoints", func(b *testing.B) { benchmarkCache(b, &eps.cache, newTestEndpoint(eps)) })
+			b.Run("services", func(b *testing.B) { benchmarkCache(b, &svc.cache, svc.new) })
+		})
+	}
+}
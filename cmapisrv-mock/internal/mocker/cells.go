@@ -17,9 +17,9 @@ import (
 	"github.com/cilium/cilium/pkg/defaults"
 	"github.com/cilium/cilium/pkg/gops"
 	"github.com/cilium/cilium/pkg/kvstore"
-	"github.com/cilium/cilium/pkg/kvstore/heartbeat"
 	"github.com/cilium/cilium/pkg/kvstore/store"
 	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/metrics"
 )
 
 var Cell = cell.Module(
@@ -31,20 +31,17 @@ var Cell = cell.Module(
 	cell.Config(defaultConfig),
 	cell.Invoke(config.validate),
 	cell.Config(defaultRndcfg),
+	cell.Provide(newClusterSpecs),
+	cell.Invoke(rndcfg.validate),
+	cell.Provide(newRecording),
+	cell.Provide(newDataset),
 
 	controller.Cell,
 
 	kvstore.Cell(kvstore.EtcdBackendName),
-	cell.Invoke(func(client kvstore.Client) error {
-		if !client.IsEnabled() {
-			return errors.New("KVStore client not configured, cannot continue")
-		}
-
-		return nil
-	}),
+	cell.DecorateAll(embeddedEtcdConfig),
+	cell.Invoke(requireKVStore),
 
-	heartbeat.Enabled,
-	heartbeat.Cell,
 	cell.Provide(func() (syncstate.SyncState, kvstore.ExtraOptions) {
 		ss := syncstate.SyncState{StoppableWaitGroup: lock.NewStoppableWaitGroup()}
 		return ss, kvstore.ExtraOptions{
@@ -60,7 +57,31 @@ var Cell = cell.Module(
 	gops.Cell(defaults.EnableGops, defaults.GopsPortKVStoreMesh),
 	cmmetrics.Cell,
 
+	metrics.Metric(newMetrics),
+	cell.Provide(newErrorTracker),
+
 	cell.Provide(newRandom),
 	cell.Provide(newMocker),
 	cell.Invoke(func(_ *mocker) {}),
 )
+
+var RecorderCell = cell.Module(
+	"recorder",
+	"Cilium Cluster Mesh Traffic Recorder",
+
+	cell.Config(defaultRecorderConfig),
+	cell.Invoke(recorderConfig.validate),
+
+	kvstore.Cell(kvstore.EtcdBackendName),
+	cell.Invoke(requireKVStore),
+
+	cell.Invoke(registerRecorder),
+)
+
+func requireKVStore(client kvstore.Client) error {
+	if !client.IsEnabled() {
+		return errors.New("KVStore client not configured, cannot continue")
+	}
+
+	return nil
+}
@@ -5,163 +5,721 @@ package mocker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os"
+	"slices"
+	"strconv"
 	"sync"
+	"time"
 
-	"golang.org/x/time/rate"
+	"k8s.io/utils/ptr"
 
 	"github.com/cilium/cilium/clustermesh-apiserver/syncstate"
+	"github.com/cilium/cilium/pkg/backoff"
 	"github.com/cilium/cilium/pkg/clustermesh/clustercfg"
+	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
 	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
-	"github.com/cilium/cilium/pkg/defaults"
+	"github.com/cilium/cilium/pkg/identity"
 	"github.com/cilium/cilium/pkg/kvstore"
 	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/lock"
 	"github.com/cilium/cilium/pkg/logging/logfields"
+	nodeStore "github.com/cilium/cilium/pkg/node/store"
+	nodeTypes "github.com/cilium/cilium/pkg/node/types"
 )
 
 type clusters struct {
-	cfg config
-	cls []cluster
+	log     *slog.Logger
+	cfg     config
+	factory store.Factory
+	backend kvstore.BackendOperations
+	raw     kvstore.BackendOperations
+	kvcfg   kvstore.Config
+	rnd     *random
+	specs   []clusterSpec
+	rec     *recording
+	ds      *dataset
+	metrics *mockerMetrics
+	errs    *errorTracker
+
+	// backends are the backends dedicated to specific clusters in direct
+	// mode, and closers the functions to close the associated connections.
+	backends map[string]kvstore.BackendOperations
+	closers  []func()
+
+	// faults are the faults injected into each cluster, by name.
+	faults map[string]*faults
+
+	// opMu serializes the connection and disconnection of clusters, and the
+	// injection of faults.
+	opMu lock.Mutex
+
+	mu           lock.RWMutex
+	ctx          context.Context
+	allSynced    <-chan struct{}
+	wg           sync.WaitGroup
+	running      map[string]*cluster
+	incarnations map[string]uint
 }
 
-func newClusters(log *slog.Logger, cfg config, factory store.Factory, backend kvstore.BackendOperations, rnd *random) clusters {
-	cls := clusters{cfg: cfg}
+var (
+	errClusterNotFound     = errors.New("cluster not found")
+	errClusterConnected    = errors.New("cluster already connected")
+	errClusterDisconnected = errors.New("cluster already disconnected")
+)
+
+func newClusters(log *slog.Logger, cfg config, specs []clusterSpec, factory store.Factory, backend kvstore.BackendOperations, kvcfg kvstore.Config, rnd *random, rec *recording, ds *dataset, metrics *mockerMetrics, errs *errorTracker) *clusters {
+	cls := &clusters{
+		rec:          rec,
+		ds:           ds,
+		metrics:      metrics,
+		errs:         errs,
+		log:          log,
+		cfg:          cfg,
+		factory:      factory,
+		backend:      newRetryingBackend(log, backend, errs),
+		raw:          backend,
+		kvcfg:        kvcfg,
+		rnd:          rnd,
+		specs:        specs,
+		backends:     make(map[string]kvstore.BackendOperations),
+		faults:       make(map[string]*faults),
+		running:      make(map[string]*cluster),
+		incarnations: make(map[string]uint),
+	}
 
-	for i := uint(0); i < cfg.Clusters; i++ {
-		id := cfg.FirstClusterID + i
-		name := fmt.Sprintf("cluster-%03d", id)
-		cls.cls = append(cls.cls, newCluster(
-			log.With("cluster", name),
-			cparams{
-				cluster:         cmtypes.ClusterInfo{ID: uint32(id), Name: name},
-				factory:         factory,
-				backend:         backend,
-				rnd:             rnd,
-				enableIPv6:      cfg.EnableIPv6,
-				encryption:      cfg.Encryption,
-				nodeAnnotations: cfg.NodeAnnotations,
-			}))
+	for _, spec := range specs {
+		cls.faults[spec.Name] = newFaults()
 	}
 
 	return cls
 }
 
-func (cls clusters) Run(ctx context.Context, ss syncstate.SyncState) {
-	var wg sync.WaitGroup
-	wg.Add(len(cls.cls))
+func (cls *clusters) Run(ctx context.Context, ss syncstate.SyncState) error {
+	defer func() {
+		cls.wg.Wait()
+		for _, closer := range cls.closers {
+			closer()
+		}
+	}()
 
-	for _, cl := range cls.cls {
-		synced := ss.WaitForResource()
-		go func(cl cluster) {
-			cl.Run(ctx, cls.cfg, synced, ss.WaitChannel())
-			wg.Done()
-		}(cl)
+	if err := cls.connect(ctx); err != nil {
+		return err
+	}
+
+	if !cls.cfg.dedicatedBackends() {
+		// The heartbeat can be stopped only if not shared with other clusters.
+		var f *faults
+		if !cls.sharedHeartbeat() && len(cls.specs) > 0 {
+			f = cls.faults[cls.specs[0].Name]
+		}
+
+		cls.wg.Add(1)
+		go func() {
+			defer cls.wg.Done()
+			writeHeartbeat(ctx, cls.backend, f)
+		}()
 	}
 
+	cls.mu.Lock()
+	cls.ctx, cls.allSynced = ctx, ss.WaitChannel()
+	for i, spec := range cls.specs {
+		if spec.Schedule.ConnectAfter == 0 {
+			cls.start(i, ss.WaitForResource(), ss.WaitChannel())
+		}
+	}
+	cls.mu.Unlock()
+
 	ss.Stop()
-	wg.Wait()
+
+	for _, spec := range cls.specs {
+		if spec.Schedule.enabled() {
+			cls.wg.Add(1)
+			go func() {
+				defer cls.wg.Done()
+				cls.schedule(ctx, spec)
+			}()
+		}
+
+		for _, fs := range spec.Faults {
+			cls.wg.Add(1)
+			go func() {
+				defer cls.wg.Done()
+				cls.scheduleFault(ctx, spec.Name, fs)
+			}()
+		}
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+// Connect starts mocking the given cluster from scratch, if not already connected.
+func (cls *clusters) Connect(name string) error {
+	cls.opMu.Lock()
+	defer cls.opMu.Unlock()
+
+	cls.mu.Lock()
+	defer cls.mu.Unlock()
+
+	idx := slices.IndexFunc(cls.specs, func(spec clusterSpec) bool { return spec.Name == name })
+	switch {
+	case idx == -1:
+		return errClusterNotFound
+	case cls.running[name] != nil:
+		return errClusterConnected
+	case cls.ctx == nil || cls.ctx.Err() != nil:
+		return errors.New("mocker not running")
+	}
+
+	// The cluster does not contribute to the readiness of the mocker, hence
+	// there's no need to signal the synchronization completion. Still, the
+	// churn starts only once all the initial clusters completed the initial
+	// synchronization, in case the mocker did not turn ready yet.
+	cls.start(idx, func(context.Context) {}, cls.allSynced)
+	return nil
+}
+
+// Disconnect stops mocking the given cluster, and removes all the associated
+// information (including the ClusterConfig) from the kvstore.
+func (cls *clusters) Disconnect(ctx context.Context, name string) error {
+	cls.opMu.Lock()
+	defer cls.opMu.Unlock()
+
+	cls.mu.Lock()
+	cl := cls.running[name]
+	delete(cls.running, name)
+	cls.mu.Unlock()
+
+	if cl == nil {
+		if !slices.ContainsFunc(cls.specs, func(spec clusterSpec) bool { return spec.Name == name }) {
+			return errClusterNotFound
+		}
+		return errClusterDisconnected
+	}
+
+	cl.log.Info("Disconnecting cluster")
+	cl.cancel()
+	<-cl.done
+
+	if err := cl.cleanup(ctx); err != nil {
+		return fmt.Errorf("removing cluster information: %w", err)
+	}
+
+	cls.metrics.deleteCluster(name)
+
+	cl.log.Info("Cluster disconnected")
+	return nil
+}
+
+// list returns the currently connected clusters, sorted as configured.
+func (cls *clusters) list() []*cluster {
+	cls.mu.RLock()
+	defer cls.mu.RUnlock()
+
+	var out []*cluster
+	for _, spec := range cls.specs {
+		if cl := cls.running[spec.Name]; cl != nil {
+			out = append(out, cl)
+		}
+	}
+
+	return out
+}
+
+// status returns the status of all clusters, including disconnected ones.
+func (cls *clusters) status() []clusterStatus {
+	cls.mu.RLock()
+	defer cls.mu.RUnlock()
+
+	var out []clusterStatus
+	for _, spec := range cls.specs {
+		if cl := cls.running[spec.Name]; cl != nil {
+			out = append(out, cl.status())
+			continue
+		}
+
+		out = append(out, clusterStatus{Name: spec.Name, ID: spec.ID, Faults: cls.faults[spec.Name].list()})
+	}
+
+	return out
+}
+
+// start creates a new instance of the cluster with the given index, and
+// starts mocking it. It must be called with the mutex held.
+func (cls *clusters) start(idx int, synced func(context.Context), allSynced <-chan struct{}) {
+	spec := cls.specs[idx]
+
+	// The snapshot, if any, only provides the initial state of the first
+	// incarnation, while subsequent ones start from scratch.
+	var cd *clusterDataset
+	if cls.incarnations[spec.Name] == 0 {
+		cd = cls.ds.cluster(spec.Name)
+	}
+
+	cl := newCluster(
+		cls.log.With("cluster", spec.Name),
+		cparams{
+			cluster: cmtypes.ClusterInfo{
+				ID:                   spec.ID,
+				Name:                 spec.Name,
+				MaxConnectedClusters: spec.ClusterConfig.MaxConnectedClusters,
+			},
+			spec:            spec,
+			factory:         cls.factory,
+			backend:         cls.backendFor(spec.Name),
+			faults:          cls.faults[spec.Name],
+			layout:          layout{direct: cls.cfg.DirectMode},
+			rnd:             cls.rnd,
+			slot:            uint(idx),
+			slots:           uint(len(cls.specs)),
+			incarnation:     cls.incarnations[spec.Name],
+			family:          spec.IPFamily,
+			encryption:      cls.cfg.Encryption,
+			nodeAnnotations: cls.cfg.NodeAnnotations,
+			recording:       cls.rec,
+			dataset:         cd,
+			replaySpeed:     cls.cfg.ReplaySpeed,
+			metrics:         cls.metrics,
+			errors:          cls.errs,
+			consistent:      cls.cfg.Consistent,
+			backendsFromEps: cls.cfg.ServiceBackendsFromEndpoints,
+			podLifecycle:    cls.cfg.PodLifecycle,
+			workers:         cls.cfg.SyncWorkers,
+			compactCache:    cls.cfg.CompactCache,
+			retryMinBackoff: cls.cfg.RetryMinBackoff,
+			retryMaxBackoff: cls.cfg.RetryMaxBackoff,
+			namespaces:      cls.rnd.Pool("namespaces", spec.IdentityShape.Namespaces),
+			serviceAccounts: cls.rnd.Pool("serviceaccounts", spec.IdentityShape.ServiceAccounts),
+		})
+
+	ctx, cancel := context.WithCancel(cls.ctx)
+	cl.cancel, cl.done = cancel, make(chan struct{})
+	cls.running[spec.Name] = cl
+	cls.incarnations[spec.Name]++
+
+	cls.wg.Add(1)
+	go func() {
+		defer cls.wg.Done()
+		defer close(cl.done)
+		cl.Run(ctx, synced, allSynced)
+	}()
 }
 
 type cluster struct {
 	log     *slog.Logger
 	backend kvstore.BackendOperations
+	// bypass is the backend not subject to the injected faults.
+	bypass kvstore.BackendOperations
+	faults *faults
+	layout layout
+	cancel context.CancelFunc
+	done   chan struct{}
+	// retry is the backoff to retry writing the ClusterConfig.
+	retry backoff.Exponential
 
 	cinfo      cmtypes.ClusterInfo
+	spec       clusterSpec
 	nodes      *nodes
 	identities *identities
 	endpoints  *endpoints
 	services   *services
+	exports    *serviceExports
+
+	// pods is set if the churn is driven by the lifecycle of pods, rather
+	// than being independent for each resource type.
+	pods *pods
+
+	// replacer is set if the rolling replacement of the nodes is enabled.
+	replacer *replacer
+
+	// rotator is set if the periodic rotation of the encryption keys is enabled.
+	rotator *rotator
+
+	// replay is set if the cluster replays a recording, rather than
+	// generating random churn.
+	replay *replayer
 }
 
 type cparams struct {
 	cluster         cmtypes.ClusterInfo
+	spec            clusterSpec
 	factory         store.Factory
 	backend         kvstore.BackendOperations
+	faults          *faults
+	layout          layout
 	rnd             *random
-	enableIPv6      bool
+	slot, slots     uint
+	incarnation     uint
+	family          ipFamily
 	encryption      encryptionMode
+	encryptionKey   *encryptionKey
 	nodeAnnotations map[string]string
+	recording       *recording
+	dataset         *clusterDataset
+	reserved        *reservations
+	replaySpeed     float64
+	metrics         *mockerMetrics
+	errors          *errorTracker
+	consistent      bool
+	backendsFromEps bool
+	podLifecycle    bool
+	workers         uint
+	compactCache    bool
+
+	retryMinBackoff, retryMaxBackoff time.Duration
+
+	namespaces, serviceAccounts []string
+}
+
+// resourceTypes lists the types of resources mocked for each cluster.
+var resourceTypes = []string{"nodes", "identities", "ips", "services", "serviceexports"}
+
+// resourceTypeAliases maps the names of the resource types in the scenario
+// file to the corresponding ones, when different.
+var resourceTypeAliases = map[string]string{"endpoints": "ips", "serviceExports": "serviceexports"}
+
+// allocators lists, for each kind of address, the types of resources allocating
+// it. The position in the list determines the slot of the associated random
+// stream, so that the addresses are interleaved only among the streams which
+// actually allocate them.
+var allocators = [...][]string{
+	nodeIPs:  {"nodes"},
+	podIPs:   {"nodes", "ips", "services"},
+	svcIPs:   {"services"},
+	podCIDRs: {"nodes"},
+}
+
+// random returns the random stream associated with the given resource type.
+func (cp cparams) random(typ string) *random {
+	rnd := cp.rnd.Stream(cp.streamName(typ))
+	for kind, types := range allocators {
+		if idx := slices.Index(types, typ); idx >= 0 {
+			n := uint(len(types))
+			rnd.Interleaved(addrKind(kind), cp.slot*n+uint(idx), cp.slots*n)
+		}
+	}
+
+	return rnd.WithPools(cp.namespaces, cp.serviceAccounts).WithReserved(cp.reserved)
+}
+
+// streamName returns the name of the random stream associated with the given
+// type. Each incarnation of a cluster (i.e., following a reconnection) is
+// associated with a different stream, so that it does not reuse the same names.
+func (cp cparams) streamName(typ string) string {
+	name := cp.cluster.Name + "/" + typ
+	if cp.incarnation > 0 {
+		name += "/" + strconv.FormatUint(uint64(cp.incarnation), 10)
+	}
+	return name
 }
 
-func newCluster(log *slog.Logger, cp cparams) cluster {
+// newSyncStore returns a new SyncStore writing the objects of the given type
+// to the given prefix, through the configured number of concurrent workers,
+// and retrying the failed operations with the configured backoff.
+func (cp cparams) newSyncStore(typ, prefix string, opts ...store.WSSOpt) store.SyncStore {
+	opts = append(opts, store.WSSWithWorkers(max(cp.workers, 1)),
+		withRetryBackoff(store.WSSWithRateLimiter, cp.retryMinBackoff, cp.retryMaxBackoff))
+	backend := newMeteredBackend(cp.backend, prefix, cp.metrics.resource(cp.cluster.Name, typ))
+	return cp.factory.NewSyncStore(cp.cluster.Name, backend, prefix, opts...)
+}
+
+func newCluster(log *slog.Logger, cp cparams) *cluster {
 	log.Info("Creating cluster")
-	cl := cluster{
+	bypass := cp.backend
+	if cp.faults != nil {
+		cp.backend = newFaultyBackend(cp.backend, cp.faults, cp.cluster.Name)
+	}
+
+	cl := &cluster{
 		log:     log,
 		backend: cp.backend,
+		bypass:  bypass,
+		faults:  cp.faults,
+		layout:  cp.layout,
 		cinfo:   cp.cluster,
+		spec:    cp.spec,
+		retry: backoff.Exponential{Logger: log, Min: cp.retryMinBackoff, Max: cp.retryMaxBackoff,
+			Jitter: true, Name: "ClusterConfig"},
+	}
 
-		nodes:      newNodes(log, cp),
-		identities: newIdentities(log, cp),
-		services:   newServices(log, cp),
+	if cp.recording != nil {
+		cl.replay = newReplayer(log, cp)
+		return cl
 	}
 
+	cp.encryptionKey = newEncryptionKey(cp.encryption)
+	if cp.dataset != nil {
+		// Make sure that new objects do not reuse the addresses of the loaded
+		// ones, and keep using the same IPsec key index.
+		cp.reserved = cp.dataset.reservations()
+		if len(cp.dataset.Nodes) > 0 && cp.dataset.Nodes[0].EncryptionKey != 0 {
+			cp.encryptionKey.current.Store(uint32(cp.dataset.Nodes[0].EncryptionKey))
+		}
+	}
+
+	cl.nodes = newNodes(log, cp)
+	cl.identities = newIdentities(log, cp)
+	cl.services = newServices(log, cp)
 	cl.endpoints = newEndpoints(log, cp, cl.nodes, cl.identities)
+	cl.exports = newServiceExports(log, cp, cl.services)
+
+	if cp.dataset != nil {
+		cl.load(cp.dataset)
+	}
+
+	if cp.backendsFromEps {
+		// Make sure that services never refer to endpoints which no longer exist.
+		cl.services.withBackendsFrom(cl.endpoints)
+		cl.endpoints.onDelete = func(ctx context.Context, endpoint *identity.IPIdentityPair) {
+			cl.services.RemoveBackend(ctx, endpoint.IP.String())
+		}
+	}
+
+	if cp.podLifecycle {
+		// Drive the churn of identities, endpoints and services through pods.
+		cl.pods = newPods(cp, cl.identities, cl.endpoints, cl.services)
+	}
+
+	// Make sure that service exports never refer to services which no longer exist.
+	cl.services.onDelete = func(ctx context.Context, service *serviceStore.ClusterService) {
+		cl.exports.RemoveFor(ctx, service)
+	}
+
+	if cp.spec.NodeReplacement.QPS > 0 {
+		cl.replacer = newReplacer(log, cp.spec.NodeReplacement, cl.nodes, cl.endpoints)
+	}
+
+	if cp.spec.KeyRotation.Interval > 0 && cp.encryption != encryptionModeDisabled {
+		cl.rotator = newRotator(log, cp.spec.KeyRotation, cp.encryption, cp.encryptionKey, cl.nodes, cl.endpoints)
+	}
+
+	if cp.consistent {
+		// Make sure that endpoints never refer to nodes and identities which
+		// no longer exist, mimicking the behavior of real clusters.
+		cl.nodes.onDelete = func(ctx context.Context, node *nodeTypes.Node) {
+			cl.endpoints.MoveFrom(ctx, hostIP(node), nil)
+		}
+		if cl.pods == nil {
+			cl.identities.onDelete = func(ctx context.Context, kv *store.KVPair) {
+				cl.endpoints.RemoveWith(ctx, cl.identities.parse(kv))
+			}
+		}
+	}
+
 	return cl
 }
 
-func (cl *cluster) Run(ctx context.Context, cfg config, synced func(context.Context), allSynced <-chan struct{}) {
+func (cl *cluster) Run(ctx context.Context, synced func(context.Context), allSynced <-chan struct{}) {
 	var wg sync.WaitGroup
+	defer wg.Wait()
 
 	cl.log.Info("Starting cluster")
 	cl.writeClusterConfig(ctx)
 
+	if cl.replay != nil {
+		cl.replay.Run(ctx, synced, allSynced)
+		return
+	}
+
 	wg.Add(1)
 	go func() {
-		cl.nodes.Run(ctx, cfg.Nodes, rate.Limit(cfg.NodesQPS), allSynced)
+		cl.nodes.Run(ctx, allSynced)
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		cl.identities.Run(ctx, cfg.Identities, rate.Limit(cfg.IdentitiesQPS), allSynced)
+		cl.identities.Run(ctx, allSynced)
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		cl.services.Run(ctx, cfg.Services, rate.Limit(cfg.ServicesQPS), allSynced)
-		wg.Done()
+		defer wg.Done()
+
+		// Backends drawn from the endpoints require them to be populated first.
+		if cl.services.endpoints != nil && cl.endpoints.WaitForSync(ctx) != nil {
+			return
+		}
+
+		cl.services.Run(ctx, allSynced)
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
-		if cl.nodes.WaitForSync(ctx) != nil || cl.identities.WaitForSync(ctx) != nil {
+		// Service exports are derived from the global services.
+		if cl.services.WaitForSync(ctx) != nil {
 			return
 		}
 
-		cl.endpoints.Run(ctx, cfg.Endpoints, rate.Limit(cfg.EndpointsQPS), allSynced)
+		cl.exports.Run(ctx, allSynced)
+	}()
+
+	if cl.replacer != nil {
+		wg.Add(1)
+		go func() {
+			cl.replacer.Run(ctx, allSynced)
+			wg.Done()
+		}()
+	}
+
+	if cl.rotator != nil {
+		wg.Add(1)
+		go func() {
+			cl.rotator.Run(ctx, allSynced)
+			wg.Done()
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if cl.nodes.WaitForSync(ctx) != nil {
+			return
+		}
+
+		// Identities are allocated on demand by the pods, if so configured,
+		// hence they get synchronized after the endpoints.
+		if cl.pods == nil && cl.identities.WaitForSync(ctx) != nil {
+			return
+		}
+
+		cl.endpoints.Run(ctx, allSynced)
 	}()
 
 	if cl.nodes.WaitForSync(ctx) != nil || cl.identities.WaitForSync(ctx) != nil ||
-		cl.endpoints.WaitForSync(ctx) != nil || cl.services.WaitForSync(ctx) != nil {
+		cl.endpoints.WaitForSync(ctx) != nil || cl.services.WaitForSync(ctx) != nil ||
+		cl.exports.WaitForSync(ctx) != nil {
 		return
 	}
 
 	synced(ctx)
-
 	<-ctx.Done()
-	wg.Wait()
 }
 
-func (cl *cluster) writeClusterConfig(ctx context.Context) {
+// controls returns the run-time tunable parameters of each mocked resource type.
+func (cl *cluster) controls() map[string]*control {
+	if cl.replay != nil {
+		return nil
+	}
+
+	return map[string]*control{
+		"nodes":          cl.nodes.ctrl,
+		"identities":     cl.identities.ctrl,
+		"ips":            cl.endpoints.ctrl,
+		"services":       cl.services.ctrl,
+		"serviceexports": cl.exports.ctrl,
+	}
+}
+
+// hold suspends the churn of all the mocked resource types, until the returned
+// function is invoked.
+func (cl *cluster) hold() (release func()) {
+	var releases []func()
+	for _, ctrl := range cl.controls() {
+		releases = append(releases, ctrl.hold())
+	}
+
+	return func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+}
+
+func (cl *cluster) status() clusterStatus {
+	status := clusterStatus{
+		Name:      cl.cinfo.Name,
+		ID:        cl.cinfo.ID,
+		Connected: true,
+		Resources: make(map[string]resourceStatus),
+		Faults:    cl.faults.list(),
+	}
+
+	for typ, ctrl := range cl.controls() {
+		status.Resources[typ] = ctrl.status()
+	}
+
+	return status
+}
+
+func (cl *cluster) clusterConfig() cmtypes.CiliumClusterConfig {
+	ccs := cl.spec.ClusterConfig
 	config := cmtypes.CiliumClusterConfig{
 		ID: cl.cinfo.ID,
 		Capabilities: cmtypes.CiliumClusterConfigCapabilities{
-			SyncedCanaries:       true,
-			MaxConnectedClusters: defaults.MaxConnectedClusters,
-			// Use the KVStoreMesh API to allow simulating multiple clusters
-			// using a single etcd instance.
-			Cached: true,
+			SyncedCanaries:           ccs.SyncedCanaries,
+			Cached:                   ccs.Cached,
+			MaxConnectedClusters:     ccs.MaxConnectedClusters,
+			EndpointSlicesExportMode: ccs.EndpointSlicesExportMode,
 		},
 	}
 
-	if err := clustercfg.Set(ctx, cl.cinfo.Name, config, cl.backend); err != nil {
-		cl.log.Error("Failed to write ClusterConfig", logfields.Error, err)
-		os.Exit(-1)
+	switch ccs.ServiceExports {
+	case serviceExportsEnabled:
+		config.Capabilities.ServiceExportsEnabled = ptr.To(true)
+	case serviceExportsDisabled:
+		config.Capabilities.ServiceExportsEnabled = ptr.To(false)
+	case serviceExportsAuto:
+		if cl.replay == nil && cl.spec.exportsEnabled() {
+			config.Capabilities.ServiceExportsEnabled = ptr.To(true)
+		}
+	}
+
+	return config
+}
+
+func (cl *cluster) writeClusterConfig(ctx context.Context) {
+	if cl.spec.ClusterConfig.Omit {
+		cl.log.Info("Omitting ClusterConfig")
+		return
+	}
+
+	config := cl.clusterConfig()
+
+	// Keep retrying with backoff until the cluster gets disconnected in the
+	// meanwhile, as the backend does not retry the failed writes.
+	retry := cl.retry
+	for {
+		err := clustercfg.Set(ctx, cl.cinfo.Name, config, cl.backend)
+		if err == nil {
+			break
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		cl.log.Warn("Failed to write ClusterConfig, retrying", logfields.Error, err)
+		if retry.Wait(ctx) != nil {
+			return
+		}
 	}
 	cl.log.Info("Written ClusterConfig")
 }
+
+// cleanup removes all the information associated with the cluster from the
+// kvstore, regardless of the injected faults.
+func (cl *cluster) cleanup(ctx context.Context) error {
+	for _, prefix := range []string{
+		kvstore.JoinKey(cl.layout.prefix(nodeStore.NodeStorePrefix), cl.cinfo.Name),
+		cl.layout.identities(cl.cinfo.Name),
+		cl.layout.endpoints(cl.cinfo.Name),
+		kvstore.JoinKey(cl.layout.prefix(serviceStore.ServiceStorePrefix), cl.cinfo.Name),
+		kvstore.JoinKey(cl.layout.prefix(ServiceExportStorePrefix), cl.cinfo.Name),
+		kvstore.JoinKey(kvstore.SyncedPrefix, cl.cinfo.Name),
+	} {
+		// Make sure to append the trailing slash, to prevent matching
+		// the keys of clusters whose name starts with the same prefix.
+		if err := cl.bypass.DeletePrefix(ctx, prefix+"/"); err != nil {
+			return err
+		}
+	}
+
+	return cl.bypass.Delete(ctx, kvstore.JoinKey(kvstore.ClusterConfigPrefix, cl.cinfo.Name))
+}
@@ -0,0 +1,835 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cilium/statedb"
+	"golang.org/x/time/rate"
+	"sigs.k8s.io/yaml"
+
+	"github.com/cilium/cilium/clustermesh-apiserver/health"
+	"github.com/cilium/cilium/clustermesh-apiserver/syncstate"
+	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
+	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
+	"github.com/cilium/cilium/pkg/defaults"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/labels"
+	"github.com/cilium/cilium/pkg/lock"
+	nodeStore "github.com/cilium/cilium/pkg/node/store"
+	nodeTypes "github.com/cilium/cilium/pkg/node/types"
+)
+
+// testClusters runs the mocker for the given configuration against an
+// in-memory kvstore, optionally starting from the given dataset, and returns
+// the clusters together with the backend. The returned function stops the
+// mocker, and waits for its termination.
+func testClusters(t *testing.T, cfg config, ds *dataset) (*clusters, kvstore.BackendOperations, func()) {
+	t.Helper()
+
+	var (
+		log     = slog.New(slog.DiscardHandler)
+		backend = kvstore.NewInMemoryClient(statedb.New(), "mocker")
+		factory = store.NewFactory(log, store.MetricsProvider())
+		ss      = syncstate.SyncState{StoppableWaitGroup: lock.NewStoppableWaitGroup()}
+	)
+
+	cls := newClusters(log, cfg, cfg.uniformClusterSpecs(), factory, backend, kvstore.Config{}, newTestRandom(t), nil, ds, newMetrics(),
+		newErrorTracker(log, cfg, nil, newMetrics()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		cls.Run(ctx, ss)
+		close(done)
+	}()
+
+	eventually(t, "initial synchronization", ss.Complete)
+
+	stop := func() {
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for the mocker to stop")
+		}
+	}
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return cls, backend, stop
+}
+
+func testConfig() config {
+	cfg := defaultConfig
+	cfg.Clusters = 2
+	cfg.Nodes, cfg.NodesQPS = 10, 100
+	cfg.Identities, cfg.IdentitiesQPS = 10, 100
+	cfg.Endpoints, cfg.EndpointsQPS = 50, 100
+	cfg.Services, cfg.ServicesQPS = 10, 100
+	return cfg
+}
+
+// count returns the number of keys of the given cluster and resource type.
+func count(t *testing.T, backend kvstore.BackendOperations, prefix, cluster string) uint {
+	t.Helper()
+
+	kvs, err := backend.ListPrefix(context.Background(), kvstore.JoinKey(kvstore.StateToCachePrefix(prefix), cluster)+"/")
+	if err != nil {
+		t.Fatalf("Failed to list prefix %q: %v", prefix, err)
+	}
+
+	return uint(len(kvs))
+}
+
+// pauseAndAudit pauses the churn in all clusters, and waits for the content
+// of the kvstore to converge to the mocker's model.
+func pauseAndAudit(t *testing.T, cls *clusters) {
+	t.Helper()
+
+	for _, cl := range cls.list() {
+		for _, ctrl := range cl.controls() {
+			ctrl.update(func(c *control) { c.paused = true })
+		}
+	}
+
+	for _, cl := range cls.list() {
+		eventually(t, "consistent audit for "+cl.cinfo.Name, func() bool {
+			report, err := cl.audit(context.Background(), "")
+			if err != nil {
+				t.Fatalf("Failed to audit cluster %q: %v", cl.cinfo.Name, err)
+			}
+			return report.Consistent
+		})
+	}
+}
+
+// operations returns the number of write operations completed for the given
+// cluster and resource type.
+func operations(cls *clusters, cluster, typ string) float64 {
+	rm := cls.metrics.resource(cluster, typ)
+	return rm.upserts.Get() + rm.deletes.Get()
+}
+
+// waitForChurn waits for each cluster to complete at least the given number of
+// write operations for each of the given resource types, to let the churn run
+// for a while.
+func waitForChurn(t *testing.T, cls *clusters, ops float64, types ...string) {
+	t.Helper()
+
+	start := make(map[string]float64)
+	for _, cl := range cls.list() {
+		for _, typ := range types {
+			start[cl.cinfo.Name+"/"+typ] = operations(cls, cl.cinfo.Name, typ)
+		}
+	}
+
+	eventually(t, fmt.Sprintf("%v operations for each cluster and type", ops), func() bool {
+		for _, cl := range cls.list() {
+			for _, typ := range types {
+				if operations(cls, cl.cinfo.Name, typ) < start[cl.cinfo.Name+"/"+typ]+ops {
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+// clusterConfig returns the ClusterConfig stored at the given key.
+func clusterConfig(t *testing.T, backend kvstore.BackendOperations, key string) cmtypes.CiliumClusterConfig {
+	t.Helper()
+
+	value, err := backend.Get(context.Background(), key)
+	if err != nil || value == nil {
+		t.Fatalf("Failed to retrieve ClusterConfig %q: %v", key, err)
+	}
+
+	var config cmtypes.CiliumClusterConfig
+	if err := json.Unmarshal(value, &config); err != nil {
+		t.Fatalf("Failed to unmarshal ClusterConfig %q: %v", key, err)
+	}
+
+	return config
+}
+
+func TestInitialSync(t *testing.T) {
+	for _, workers := range []uint{1, 16} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			// Disable the churn, so that the number of objects matches the targets.
+			cfg := testConfig()
+			cfg.NodesQPS, cfg.IdentitiesQPS, cfg.EndpointsQPS, cfg.ServicesQPS = 0, 0, 0, 0
+			cfg.Endpoints, cfg.SyncWorkers = 500, workers
+			cls, backend, _ := testClusters(t, cfg, nil)
+
+			for _, cl := range cls.list() {
+				for prefix, target := range map[string]uint{
+					nodeStore.NodeStorePrefix:       cfg.Nodes,
+					IdentitiesPath:                  cfg.Identities,
+					IPIdentitiesPath:                cfg.Endpoints,
+					serviceStore.ServiceStorePrefix: cfg.Services,
+				} {
+					// The synchronization completes only once all the initial
+					// objects have been written to the kvstore, regardless of
+					// the number of concurrent workers.
+					if got := count(t, backend, prefix, cl.cinfo.Name); got != target {
+						t.Errorf("Cluster %q, prefix %q: expected %d keys, got %d", cl.cinfo.Name, prefix, target, got)
+					}
+				}
+
+				for typ, target := range map[string]uint{
+					"nodes": cfg.Nodes, "identities": cfg.Identities, "ips": cfg.Endpoints, "services": cfg.Services,
+				} {
+					// Only the completed kvstore writes are accounted for,
+					// excluding the ones of the sync canaries.
+					if got := cls.metrics.resource(cl.cinfo.Name, typ).upserts.Get(); got != float64(target) {
+						t.Errorf("Cluster %q, type %q: expected %d upserts, got %v", cl.cinfo.Name, typ, target, got)
+					}
+				}
+
+				if _, err := backend.Get(context.Background(), kvstore.JoinKey(kvstore.ClusterConfigPrefix, cl.cinfo.Name)); err != nil {
+					t.Errorf("Failed to retrieve ClusterConfig for cluster %q: %v", cl.cinfo.Name, err)
+				}
+			}
+
+			pauseAndAudit(t, cls)
+		})
+	}
+}
+
+func TestChurnConsistency(t *testing.T) {
+	for _, compact := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compact=%t", compact), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Consistent = true
+			cfg.ServiceBackendsFromEndpoints = true
+			cfg.CompactCache = compact
+			cls, backend, _ := testClusters(t, cfg, nil)
+
+			// Let the churn run for a while, before checking that the content of the
+			// kvstore matches the mocker's model.
+			waitForChurn(t, cls, 50, "nodes", "identities", "ips", "services")
+			pauseAndAudit(t, cls)
+
+			kvs, err := backend.ListPrefix(context.Background(), "cilium/cache/")
+			if err != nil {
+				t.Fatalf("Failed to list keys: %v", err)
+			}
+
+			for _, cl := range cls.list() {
+				var (
+					hosts = make(map[string]struct{})
+					ids   = make(map[string]struct{})
+					ips   = make(map[string]struct{})
+				)
+
+				for key, value := range kvs {
+					switch {
+					case strings.HasPrefix(key, kvstore.JoinKey(kvstore.StateToCachePrefix(nodeStore.NodeStorePrefix), cl.cinfo.Name)+"/"):
+						var node nodeTypes.Node
+						if err := json.Unmarshal(value.Data, &node); err != nil {
+							t.Fatalf("Failed to unmarshal node %q: %v", key, err)
+						}
+						hosts[node.GetNodeIP(false).String()] = struct{}{}
+					case strings.HasPrefix(key, kvstore.JoinKey(kvstore.StateToCachePrefix(IdentitiesPath), cl.cinfo.Name, "id")+"/"):
+						ids[key[strings.LastIndex(key, "/")+1:]] = struct{}{}
+					case strings.HasPrefix(key, kvstore.JoinKey(kvstore.StateToCachePrefix(IPIdentitiesPath), cl.cinfo.Name)+"/"):
+						ips[key[strings.LastIndex(key, "/")+1:]] = struct{}{}
+					}
+				}
+
+				for key, value := range kvs {
+					switch {
+					case strings.HasPrefix(key, kvstore.JoinKey(kvstore.StateToCachePrefix(IPIdentitiesPath), cl.cinfo.Name)+"/"):
+						var pair identity.IPIdentityPair
+						if err := json.Unmarshal(value.Data, &pair); err != nil {
+							t.Fatalf("Failed to unmarshal endpoint %q: %v", key, err)
+						}
+
+						if _, ok := hosts[pair.HostIP.String()]; !ok {
+							t.Errorf("Endpoint %q references unknown node %s", key, pair.HostIP)
+						}
+						if _, ok := ids[pair.ID.String()]; !ok {
+							t.Errorf("Endpoint %q references unknown identity %s", key, pair.ID)
+						}
+					case strings.HasPrefix(key, kvstore.JoinKey(kvstore.StateToCachePrefix(serviceStore.ServiceStorePrefix), cl.cinfo.Name)+"/"):
+						var svc serviceStore.ClusterService
+						if err := json.Unmarshal(value.Data, &svc); err != nil {
+							t.Fatalf("Failed to unmarshal service %q: %v", key, err)
+						}
+
+						for ip := range svc.Backends {
+							if _, ok := ips[ip]; !ok {
+								t.Errorf("Service %q references unknown backend %s", key, ip)
+							}
+						}
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAuditDuringChurn(t *testing.T) {
+	cfg := testConfig()
+	cfg.Consistent = true
+	cfg.NodesQPS, cfg.IdentitiesQPS, cfg.EndpointsQPS, cfg.ServicesQPS = 1000, 1000, 1000, 1000
+	cls, _, _ := testClusters(t, cfg, nil)
+	mk := &mocker{log: slog.New(slog.DiscardHandler), cls: cls}
+
+	total := func() (total float64) {
+		for _, cl := range cls.list() {
+			for typ := range cl.controls() {
+				total += operations(cls, cl.cinfo.Name, typ)
+			}
+		}
+		return total
+	}
+
+	// No operations are performed while the churn is held, once the in-flight
+	// ones completed.
+	var releases []func()
+	for _, cl := range cls.list() {
+		releases = append(releases, cl.hold())
+		eventually(t, "consistent audit for "+cl.cinfo.Name, func() bool {
+			report, err := cl.audit(context.Background(), "")
+			return err == nil && report.Consistent
+		})
+	}
+
+	held := total()
+	time.Sleep(100 * time.Millisecond)
+	if got := total(); got != held {
+		t.Errorf("Unexpected operations while the churn is held, before: %v, after: %v", held, got)
+	}
+
+	for _, release := range releases {
+		release()
+	}
+	eventually(t, "the churn to resume", func() bool { return total() > held })
+
+	// The churn is held while auditing, so that the operations in-flight are
+	// not reported as differences, and subsequently resumed.
+	for range 3 {
+		rec := httptest.NewRecorder()
+		mk.audit(rec, httptest.NewRequest(http.MethodGet, "/clusters/audit", nil))
+
+		var reports []clusterAudit
+		if err := json.NewDecoder(rec.Body).Decode(&reports); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("Unexpected audit response (code %d): %v", rec.Code, err)
+		}
+
+		for _, report := range reports {
+			if !report.Consistent {
+				t.Errorf("Cluster %q unexpectedly inconsistent: %+v", report.Name, report.Resources)
+			}
+		}
+
+		for _, cl := range cls.list() {
+			for typ, ctrl := range cl.controls() {
+				if ctrl.state().paused {
+					t.Errorf("Cluster %q, type %q: churn still paused after the audit", cl.cinfo.Name, typ)
+				}
+			}
+		}
+	}
+}
+
+func TestTargetConvergence(t *testing.T) {
+	cfg := testConfig()
+	cfg.Clusters = 1
+	cls, backend, _ := testClusters(t, cfg, nil)
+	cl := cls.list()[0]
+
+	tune := func(target uint) {
+		cl.endpoints.ctrl.update(func(c *control) {
+			c.target, c.qps = target, rate.Limit(1000)
+		})
+	}
+
+	// The number of objects fluctuates around the target, as the churn
+	// keeps creating and deleting objects, hence use lenient bounds.
+	for _, target := range []uint{200, 20} {
+		tune(target)
+		eventually(t, "convergence to the new target", func() bool {
+			got := count(t, backend, IPIdentitiesPath, cl.cinfo.Name)
+			return got >= target*8/10 && got <= target*12/10
+		})
+	}
+}
+
+func TestTuneTypes(t *testing.T) {
+	cfg := testConfig()
+	cfg.Clusters = 1
+	cls, _, _ := testClusters(t, cfg, nil)
+	cl := cls.list()[0]
+
+	mk := &mocker{log: slog.New(slog.DiscardHandler), cls: cls}
+	tune := func(typ string) int {
+		rec := httptest.NewRecorder()
+		mk.tune(rec, httptest.NewRequest(http.MethodPost, "/clusters/pause?type="+typ, nil), nil,
+			func(c *control) { c.paused = true })
+		return rec.Code
+	}
+
+	if code := tune("unknown"); code != http.StatusBadRequest {
+		t.Errorf("Unknown type unexpectedly accepted (code %d)", code)
+	}
+
+	// The names used in the scenario file are accepted as well.
+	if code := tune("endpoints"); code != http.StatusOK || !cl.endpoints.ctrl.state().paused || cl.nodes.ctrl.state().paused {
+		t.Errorf("Unexpected status after pausing the endpoints (code %d)", code)
+	}
+}
+
+func TestNodeReplacement(t *testing.T) {
+	for _, policy := range []endpointsPolicy{endpointsPolicyMove, endpointsPolicyRemove} {
+		t.Run(string(policy), func(t *testing.T) {
+			// A single node exercises the endpoints being placed while the
+			// only node is being replaced.
+			cfg := testConfig()
+			cfg.Clusters, cfg.Nodes = 1, 1
+			cfg.Consistent = true
+			cfg.NodeReplacementQPS, cfg.NodeReplacementEndpoints = 100, string(policy)
+			cls, backend, _ := testClusters(t, cfg, nil)
+			cl := cls.list()[0]
+
+			waitForChurn(t, cls, 50, "nodes", "ips")
+			pauseAndAudit(t, cls)
+
+			hosts := make(map[string]struct{})
+			for _, no := range cl.nodes.cache.Select(func(*nodeTypes.Node) bool { return true }) {
+				hosts[hostIP(no).String()] = struct{}{}
+			}
+
+			if got := count(t, backend, nodeStore.NodeStorePrefix, cl.cinfo.Name); got != uint(len(hosts)) {
+				t.Fatalf("Expected %d nodes after the replacements, got %d", len(hosts), got)
+			}
+
+			for _, endpoint := range cl.endpoints.cache.Select(func(*identity.IPIdentityPair) bool { return true }) {
+				if _, ok := hosts[endpoint.HostIP.String()]; !ok {
+					t.Errorf("Endpoint %q references replaced node %s", endpoint.GetKeyName(), endpoint.HostIP)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownAndDisconnect(t *testing.T) {
+	cls, backend, stop := testClusters(t, testConfig(), nil)
+	name := cls.list()[0].cinfo.Name
+
+	if err := cls.Disconnect(context.Background(), name); err != nil {
+		t.Fatalf("Failed to disconnect cluster %q: %v", name, err)
+	}
+
+	kvs, err := backend.ListPrefix(context.Background(), "cilium/")
+	if err != nil {
+		t.Fatalf("Failed to list keys: %v", err)
+	}
+
+	for key := range kvs {
+		if strings.Contains(key, "/"+name+"/") || strings.HasSuffix(key, "/"+name) {
+			t.Errorf("Key %q of disconnected cluster %q still present", key, name)
+		}
+	}
+
+	if len(cls.list()) != 1 {
+		t.Errorf("Expected one cluster still connected, got %d", len(cls.list()))
+	}
+
+	stop()
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	cfg := testConfig()
+	cfg.Consistent = true
+	src, _, stop := testClusters(t, cfg, nil)
+
+	waitForChurn(t, src, 20, "nodes", "identities", "ips", "services")
+	pauseAndAudit(t, src)
+
+	ds := dataset{Version: datasetVersion}
+	for _, cl := range src.list() {
+		ds.Clusters = append(ds.Clusters, cl.export())
+	}
+	stop()
+
+	// Go through the serialized representation, as if read from file.
+	data, err := yaml.Marshal(ds)
+	if err != nil {
+		t.Fatalf("Failed to marshal snapshot: %v", err)
+	}
+
+	var loaded dataset
+	if err := yaml.Unmarshal(data, &loaded); err != nil {
+		t.Fatalf("Failed to unmarshal snapshot: %v", err)
+	}
+
+	if err := loaded.validate(cfg.uniformClusterSpecs()); err != nil {
+		t.Fatalf("Failed to validate snapshot: %v", err)
+	}
+
+	// Disable the churn, so that the clusters can be compared with the snapshot.
+	cfg.NodesQPS, cfg.IdentitiesQPS, cfg.EndpointsQPS, cfg.ServicesQPS = 0, 0, 0, 0
+	dst, _, _ := testClusters(t, cfg, &loaded)
+	for _, cl := range dst.list() {
+		if got, expected := mustMarshal(t, cl.export()), mustMarshal(t, ds.cluster(cl.cinfo.Name)); got != expected {
+			t.Errorf("Cluster %q does not match the snapshot:\ngot:      %s\nexpected: %s", cl.cinfo.Name, got, expected)
+		}
+	}
+
+	// The random churn continues from the loaded state.
+	for _, cl := range dst.list() {
+		for _, ctrl := range cl.controls() {
+			ctrl.update(func(c *control) { c.qps = 100 })
+		}
+	}
+
+	waitForChurn(t, dst, 20, "nodes", "identities", "ips", "services")
+	pauseAndAudit(t, dst)
+}
+
+func TestDirectMode(t *testing.T) {
+	cfg := testConfig()
+	cfg.NodesQPS, cfg.IdentitiesQPS, cfg.EndpointsQPS, cfg.ServicesQPS = 0, 0, 0, 0
+	cfg.DirectMode, cfg.DirectKeyPrefix = true, "{cluster}/"
+	cls, backend, _ := testClusters(t, cfg, nil)
+
+	for _, cl := range cls.list() {
+		name := cl.cinfo.Name
+		for prefix, target := range map[string]uint{
+			kvstore.JoinKey(nodeStore.NodeStorePrefix, name):       cfg.Nodes,
+			kvstore.JoinKey(IdentitiesPath, "id"):                  cfg.Identities,
+			kvstore.JoinKey(IPIdentitiesPath, addressSpace):        cfg.Endpoints,
+			kvstore.JoinKey(serviceStore.ServiceStorePrefix, name): cfg.Services,
+		} {
+			kvs, err := backend.ListPrefix(context.Background(), name+"/"+prefix+"/")
+			if err != nil {
+				t.Fatalf("Failed to list prefix %q: %v", prefix, err)
+			}
+
+			if uint(len(kvs)) != target {
+				t.Errorf("Cluster %q, prefix %q: expected %d keys, got %d", name, prefix, target, len(kvs))
+			}
+		}
+
+		for _, key := range []string{
+			kvstore.JoinKey(kvstore.SyncedPrefix, name, IdentitiesPath),
+			kvstore.JoinKey(kvstore.SyncedPrefix, name, IPIdentitiesPath),
+			kvstore.HeartbeatPath,
+		} {
+			if _, err := backend.Get(context.Background(), name+"/"+key); err != nil {
+				t.Errorf("Failed to retrieve key %q for cluster %q: %v", key, name, err)
+			}
+		}
+
+		if config := clusterConfig(t, backend, name+"/"+kvstore.JoinKey(kvstore.ClusterConfigPrefix, name)); config.Capabilities.Cached {
+			t.Errorf("Unexpected ClusterConfig for cluster %q: %+v", name, config)
+		}
+	}
+
+	if kvs, _ := backend.ListPrefix(context.Background(), "cilium/"); len(kvs) != 0 {
+		t.Errorf("Unexpected keys outside of the per-cluster prefixes: %v", slices.Collect(maps.Keys(kvs)))
+	}
+
+	pauseAndAudit(t, cls)
+}
+
+func TestServiceExports(t *testing.T) {
+	cfg := testConfig()
+	cfg.ServiceExports, cfg.ServiceExportsQPS = 5, 100
+	cls, backend, _ := testClusters(t, cfg, nil)
+
+	// Let the churn run for a while, so that services get removed as well.
+	waitForChurn(t, cls, 50, "services", "serviceexports")
+	pauseAndAudit(t, cls)
+
+	for _, cl := range cls.list() {
+		services, err := backend.ListPrefix(context.Background(), kvstore.JoinKey(kvstore.StateToCachePrefix(serviceStore.ServiceStorePrefix), cl.cinfo.Name)+"/")
+		if err != nil {
+			t.Fatalf("Failed to list services: %v", err)
+		}
+
+		exports, err := backend.ListPrefix(context.Background(), kvstore.JoinKey(kvstore.StateToCachePrefix(ServiceExportStorePrefix), cl.cinfo.Name)+"/")
+		if err != nil {
+			t.Fatalf("Failed to list service exports: %v", err)
+		}
+
+		if len(exports) == 0 {
+			t.Errorf("No service exports found for cluster %q", cl.cinfo.Name)
+		}
+
+		for key := range exports {
+			value, ok := services[strings.Replace(key, kvstore.StateToCachePrefix(ServiceExportStorePrefix),
+				kvstore.StateToCachePrefix(serviceStore.ServiceStorePrefix), 1)]
+			if !ok {
+				t.Errorf("Service export %q references unknown service", key)
+				continue
+			}
+
+			var svc serviceStore.ClusterService
+			if err := json.Unmarshal(value.Data, &svc); err != nil || !svc.IncludeExternal {
+				t.Errorf("Service export %q references non-global service", key)
+			}
+		}
+
+		config := clusterConfig(t, backend, kvstore.JoinKey(kvstore.ClusterConfigPrefix, cl.cinfo.Name))
+		if config.Capabilities.ServiceExportsEnabled == nil || !*config.Capabilities.ServiceExportsEnabled {
+			t.Errorf("Unexpected ClusterConfig for cluster %q: %+v", cl.cinfo.Name, config)
+		}
+	}
+}
+
+func TestFaults(t *testing.T) {
+	cfg := testConfig()
+	cfg.Clusters = 1
+	cls, backend, _ := testClusters(t, cfg, nil)
+
+	var (
+		ctx    = context.Background()
+		name   = cls.list()[0].cinfo.Name
+		synced = kvstore.JoinKey(kvstore.SyncedPrefix, name) + "/"
+		config = kvstore.JoinKey(kvstore.ClusterConfigPrefix, name)
+	)
+
+	keys := func(prefix string) []string {
+		kvs, err := backend.ListPrefix(ctx, prefix)
+		if err != nil {
+			t.Fatalf("Failed to list prefix %q: %v", prefix, err)
+		}
+		return slices.Sorted(maps.Keys(kvs))
+	}
+
+	inject := func(typ faultType) {
+		if err := cls.Inject(ctx, name, typ); err != nil {
+			t.Fatalf("Failed to inject fault %q: %v", typ, err)
+		}
+	}
+
+	clearFault := func(typ faultType) {
+		if err := cls.Clear(ctx, name, typ); err != nil {
+			t.Fatalf("Failed to clear fault %q: %v", typ, err)
+		}
+	}
+
+	canaries := keys(synced)
+	if len(canaries) == 0 {
+		t.Fatal("No sync canaries found")
+	}
+
+	// The heartbeat is resumed immediately once the fault is cleared.
+	inject(faultHeartbeat)
+	if err := backend.Delete(ctx, kvstore.HeartbeatPath); err != nil {
+		t.Fatalf("Failed to delete heartbeat: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if value, _ := backend.Get(ctx, kvstore.HeartbeatPath); value != nil {
+		t.Error("Heartbeat unexpectedly updated while stopped")
+	}
+	clearFault(faultHeartbeat)
+	eventually(t, "heartbeat resumed", func() bool {
+		value, _ := backend.Get(ctx, kvstore.HeartbeatPath)
+		return value != nil
+	})
+
+	inject(faultCanaries)
+	if err := cls.Inject(ctx, name, faultCanaries); !errors.Is(err, errFaultInjected) {
+		t.Errorf("Expected error injecting an already injected fault, got %v", err)
+	}
+	if got := keys(synced); len(got) != 0 {
+		t.Errorf("Sync canaries unexpectedly present while withheld: %v", got)
+	}
+	clearFault(faultCanaries)
+	if got := keys(synced); !slices.Equal(got, canaries) {
+		t.Errorf("Sync canaries not restored, expected %v, got %v", canaries, got)
+	}
+
+	// The churn is still ongoing, but no writes reach the kvstore.
+	nodes := kvstore.JoinKey(kvstore.StateToCachePrefix(nodeStore.NodeStorePrefix), name) + "/"
+	inject(faultFreeze)
+	time.Sleep(100 * time.Millisecond)
+	frozen := keys(nodes)
+	time.Sleep(200 * time.Millisecond)
+	if got := keys(nodes); !slices.Equal(got, frozen) {
+		t.Error("Keys unexpectedly modified while frozen")
+	}
+	clearFault(faultFreeze)
+	pauseAndAudit(t, cls)
+
+	inject(faultVanish)
+	for _, prefix := range []string{nodes, synced, config} {
+		if got := keys(prefix); len(got) != 0 {
+			t.Errorf("Keys unexpectedly present after vanishing: %v", got)
+		}
+	}
+	clearFault(faultVanish)
+	pauseAndAudit(t, cls)
+	if got := keys(synced); !slices.Equal(got, canaries) {
+		t.Errorf("Sync canaries not restored, expected %v, got %v", canaries, got)
+	}
+	if value, _ := backend.Get(ctx, config); value == nil {
+		t.Error("ClusterConfig not restored")
+	}
+
+	if st := cls.status(); len(st) != 1 || len(st[0].Faults) != 0 {
+		t.Errorf("Unexpected faults still active: %+v", st)
+	}
+}
+
+func TestClusterConfig(t *testing.T) {
+	cfg := testConfig()
+	cfg.FirstClusterID, cfg.MaxConnectedClusters = 300, cmtypes.ClusterIDExt511
+	cls, backend, _ := testClusters(t, cfg, nil)
+
+	for _, cl := range cls.list() {
+		config := clusterConfig(t, backend, kvstore.JoinKey(kvstore.ClusterConfigPrefix, cl.cinfo.Name))
+		if config.Capabilities.MaxConnectedClusters != cmtypes.ClusterIDExt511 || !config.Capabilities.Cached {
+			t.Errorf("Unexpected ClusterConfig for cluster %q: %+v", cl.cinfo.Name, config)
+		}
+
+		// Identities encode the cluster ID in the 9 most significant bits.
+		for _, kv := range cached(&cl.identities.cache) {
+			if id := cl.identities.parse(kv); uint32(id)>>15 != cl.cinfo.ID {
+				t.Errorf("Identity %d does not belong to cluster %d", id, cl.cinfo.ID)
+			}
+		}
+	}
+
+	cfg = testConfig()
+	cfg.OmitClusterConfig = true
+	cls, backend, _ = testClusters(t, cfg, nil)
+
+	for _, cl := range cls.list() {
+		if value, _ := backend.Get(context.Background(), kvstore.JoinKey(kvstore.ClusterConfigPrefix, cl.cinfo.Name)); value != nil {
+			t.Errorf("Unexpected ClusterConfig for cluster %q: %s", cl.cinfo.Name, value)
+		}
+	}
+
+	cfg.FirstClusterID, cfg.MaxConnectedClusters = 300, defaults.MaxConnectedClusters
+	if _, err := newClusterSpecs(cfg); err == nil {
+		t.Error("Cluster IDs exceeding the max connected clusters unexpectedly accepted")
+	}
+}
+
+func TestPodLifecycle(t *testing.T) {
+	cfg := testConfig()
+	cfg.PodLifecycle, cfg.Consistent = true, true
+	// Configure more workloads than pods, so that identities get frequently
+	// deleted once the last pod of the corresponding workload is deleted.
+	cfg.Identities, cfg.IdentitiesQPS = 100, 10
+	if _, err := newClusterSpecs(cfg); err == nil {
+		t.Error("Identities QPS unexpectedly accepted in the pod lifecycle mode")
+	}
+
+	cfg.IdentitiesQPS = 0
+	cls, backend, _ := testClusters(t, cfg, nil)
+
+	// The identities target sets the number of workloads, while tuning the
+	// QPS is rejected, as the churn is driven by the pods only.
+	mk := &mocker{log: slog.New(slog.DiscardHandler), cls: cls}
+	idx := slices.IndexFunc(mk.controlEndpoints(), func(ep health.EndpointFunc) bool { return ep.Path == "PATCH /clusters" })
+	patch := func(body string) int {
+		rec := httptest.NewRecorder()
+		mk.controlEndpoints()[idx].HandlerFunc(rec, httptest.NewRequest(http.MethodPatch, "/clusters?type=identities",
+			strings.NewReader(body)))
+		return rec.Code
+	}
+
+	if code := patch(`{"target": 1, "qps": 1000}`); code != http.StatusBadRequest {
+		t.Errorf("Identities QPS unexpectedly accepted in the pod lifecycle mode (code %d)", code)
+	}
+
+	code := patch(fmt.Sprintf(`{"target": %d}`, cfg.Identities))
+	for _, cl := range cls.list() {
+		if st := cl.identities.ctrl.status(); code != http.StatusOK || st.Target != cfg.Identities || st.QPS != 0 {
+			t.Errorf("Unexpected identities status in the pod lifecycle mode (code %d): %+v", code, st)
+		}
+	}
+
+	// Let the pods be started and deleted for a while, before checking that
+	// identities, endpoints and services are correlated.
+	waitForChurn(t, cls, 50, "ips")
+	pauseAndAudit(t, cls)
+
+	kvs, err := backend.ListPrefix(context.Background(), "cilium/cache/")
+	if err != nil {
+		t.Fatalf("Failed to list keys: %v", err)
+	}
+
+	for _, cl := range cls.list() {
+		var (
+			// workloads maps each identity to the namespace/app of the
+			// workload, and pods each workload to the running pods.
+			workloads = make(map[string]string)
+			pods      = make(map[string][]string)
+		)
+
+		for key, value := range kvs {
+			if strings.HasPrefix(key, kvstore.JoinKey(kvstore.StateToCachePrefix(IdentitiesPath), cl.cinfo.Name, "id")+"/") {
+				lbls := labels.NewLabelArrayFromSortedList(string(value.Data))
+				workloads[key[strings.LastIndex(key, "/")+1:]] =
+					lbls.Get("k8s:io.kubernetes.pod.namespace") + "/" + lbls.Get("k8s:app")
+			}
+		}
+
+		if len(workloads) == 0 || len(workloads) > int(cfg.Identities) {
+			t.Errorf("Unexpected number of identities for cluster %q: %d", cl.cinfo.Name, len(workloads))
+		}
+
+		for key, value := range kvs {
+			if strings.HasPrefix(key, kvstore.JoinKey(kvstore.StateToCachePrefix(IPIdentitiesPath), cl.cinfo.Name)+"/") {
+				var pair identity.IPIdentityPair
+				if err := json.Unmarshal(value.Data, &pair); err != nil {
+					t.Fatalf("Failed to unmarshal endpoint %q: %v", key, err)
+				}
+
+				wl, ok := workloads[pair.ID.StringID()]
+				if !ok || !strings.HasPrefix(wl, pair.K8sNamespace+"/") {
+					t.Errorf("Endpoint %q references unknown identity %s", key, pair.ID)
+				}
+				pods[wl] = append(pods[wl], pair.IP.String())
+			}
+		}
+
+		for id, wl := range workloads {
+			if len(pods[wl]) == 0 {
+				t.Errorf("Identity %s of cluster %q not deleted once unused", id, cl.cinfo.Name)
+			}
+		}
+
+		for key, value := range kvs {
+			if strings.HasPrefix(key, kvstore.JoinKey(kvstore.StateToCachePrefix(serviceStore.ServiceStorePrefix), cl.cinfo.Name)+"/") {
+				var svc serviceStore.ClusterService
+				if err := json.Unmarshal(value.Data, &svc); err != nil {
+					t.Fatalf("Failed to unmarshal service %q: %v", key, err)
+				}
+
+				got := slices.Sorted(maps.Keys(svc.Backends))
+				expected := slices.Sorted(slices.Values(pods[svc.Namespace+"/"+svc.Selector["app"]]))
+				if !slices.Equal(got, expected) {
+					t.Errorf("Service %q does not select all the running pods, expected %v, got %v", key, expected, got)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"fmt"
+
+	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
+	"github.com/cilium/cilium/pkg/defaults"
+	"github.com/cilium/cilium/pkg/identity"
+)
+
+// serviceExportsSupport configures the ServiceExportsEnabled capability, which
+// distinguishes between clusters not supporting MCS-API service exports at all,
+// and clusters supporting but not enabling them.
+type serviceExportsSupport string
+
+const (
+	// serviceExportsAuto advertises service exports as enabled if they are
+	// mocked for the given cluster, and as not supported otherwise.
+	serviceExportsAuto        = serviceExportsSupport("")
+	serviceExportsEnabled     = serviceExportsSupport("enabled")
+	serviceExportsDisabled    = serviceExportsSupport("disabled")
+	serviceExportsUnsupported = serviceExportsSupport("unsupported")
+)
+
+func (s serviceExportsSupport) validate() error {
+	switch s {
+	case serviceExportsAuto, serviceExportsEnabled, serviceExportsDisabled, serviceExportsUnsupported:
+		return nil
+	default:
+		return fmt.Errorf("unsupported service exports mode %q; must be one of enabled|disabled|unsupported", s)
+	}
+}
+
+// clusterConfigSpec configures the ClusterConfig advertised by a mocked cluster,
+// to emulate remote clusters running older or newer Cilium versions. Only the
+// advertised capabilities are affected, except for MaxConnectedClusters, which
+// additionally determines how the cluster ID is encoded in the mocked identities.
+type clusterConfigSpec struct {
+	// Omit disables writing the ClusterConfig, as very old Cilium versions
+	// did not write it at all.
+	Omit bool
+
+	SyncedCanaries           bool
+	Cached                   bool
+	MaxConnectedClusters     uint32
+	ServiceExports           serviceExportsSupport
+	EndpointSlicesExportMode cmtypes.EndpointSlicesExportMode
+}
+
+func validateMaxConnectedClusters(value uint32) error {
+	switch value {
+	case 0, defaults.MaxConnectedClusters, cmtypes.ClusterIDExt511:
+		return nil
+	default:
+		return fmt.Errorf("unsupported max connected clusters %d; must be one of 0|%d|%d",
+			value, defaults.MaxConnectedClusters, cmtypes.ClusterIDExt511)
+	}
+}
+
+func (ccs clusterConfigSpec) validate(id uint32) error {
+	if err := validateMaxConnectedClusters(ccs.MaxConnectedClusters); err != nil {
+		return fmt.Errorf("cluster config: %w", err)
+	}
+
+	if idMax := ccs.clusterIDMax(); id > idMax {
+		return fmt.Errorf("cluster config: cluster ID %d exceeds the maximum one (%d) supported "+
+			"given the max connected clusters setting", id, idMax)
+	}
+
+	if err := ccs.ServiceExports.validate(); err != nil {
+		return fmt.Errorf("cluster config: %w", err)
+	}
+
+	switch ccs.EndpointSlicesExportMode {
+	case cmtypes.EndpointSlicesExportModeServicesOnly,
+		cmtypes.EndpointSlicesExportModeServicesAndEndpointSlices,
+		cmtypes.EndpointSlicesExportModeEndpointSlicesOnly:
+	default:
+		return fmt.Errorf("cluster config: unsupported endpoint slices export mode %q; must be either empty or one of %s|%s",
+			ccs.EndpointSlicesExportMode, cmtypes.EndpointSlicesExportModeServicesAndEndpointSlices,
+			cmtypes.EndpointSlicesExportModeEndpointSlicesOnly)
+	}
+
+	return nil
+}
+
+// clusterIDMax returns the maximum cluster ID, with clusters not advertising
+// the maximum number of connected clusters defaulting to 255.
+func (ccs clusterConfigSpec) clusterIDMax() uint32 {
+	if ccs.MaxConnectedClusters == 0 {
+		return defaults.MaxConnectedClusters
+	}
+	return ccs.MaxConnectedClusters
+}
+
+// identityBits returns the number of bits representing the cluster-local
+// portion of the numeric identities, given the maximum number of connected
+// clusters. It matches identity.GetClusterIDShift, which is a process-wide
+// setting, while the mocked clusters may differ from one another.
+func identityBits(maxConnectedClusters uint32) uint32 {
+	if maxConnectedClusters == cmtypes.ClusterIDExt511 {
+		return identity.NumericIdentityBitlength - 9
+	}
+	return identity.NumericIdentityBitlength - 8
+}
+
+// scenarioClusterConfig overrides the individual settings of the ClusterConfig
+// advertised by a group of clusters.
+type scenarioClusterConfig struct {
+	Omit                     *bool                             `json:"omit"`
+	SyncedCanaries           *bool                             `json:"syncedCanaries"`
+	Cached                   *bool                             `json:"cached"`
+	MaxConnectedClusters     *uint32                           `json:"maxConnectedClusters"`
+	ServiceExports           *serviceExportsSupport            `json:"serviceExports"`
+	EndpointSlicesExportMode *cmtypes.EndpointSlicesExportMode `json:"endpointSlicesExportMode"`
+}
+
+func (scc scenarioClusterConfig) resolve(def clusterConfigSpec) clusterConfigSpec {
+	if scc.Omit != nil {
+		def.Omit = *scc.Omit
+	}
+
+	if scc.SyncedCanaries != nil {
+		def.SyncedCanaries = *scc.SyncedCanaries
+	}
+
+	if scc.Cached != nil {
+		def.Cached = *scc.Cached
+	}
+
+	if scc.MaxConnectedClusters != nil {
+		def.MaxConnectedClusters = *scc.MaxConnectedClusters
+	}
+
+	if scc.ServiceExports != nil {
+		def.ServiceExports = *scc.ServiceExports
+	}
+
+	if scc.EndpointSlicesExportMode != nil {
+		def.EndpointSlicesExportMode = *scc.EndpointSlicesExportMode
+	}
+
+	return def
+}
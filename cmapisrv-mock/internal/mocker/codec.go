@@ -0,0 +1,340 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"encoding/binary"
+	"maps"
+	"net"
+	"net/netip"
+	"reflect"
+
+	"github.com/cilium/cilium/pkg/cidr"
+	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
+	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/node/addressing"
+	nodeTypes "github.com/cilium/cilium/pkg/node/types"
+)
+
+// codec converts the cached objects to and from a compact representation. The
+// encoding fails for objects which would not be decoded as they are, as holding
+// fields neither encoded nor derived from the configuration (e.g., for objects
+// loaded from a snapshot generated with a different configuration), in which
+// case the cache falls back to storing them as they are. The lossless round
+// trip of the mocked objects is verified by the unit tests, rather than for
+// each object, to keep the encoding cheap.
+type codec[T store.Key] interface {
+	encode(value T) (packed string, ok bool)
+	decode(packed string) T
+}
+
+func (cp cparams) nodeCodec() codec[*nodeTypes.Node] {
+	if !cp.compactCache {
+		return nil
+	}
+
+	return nodeCodec{cluster: cp.cluster, annotations: cp.nodeAnnotations}
+}
+
+func (cp cparams) endpointCodec() codec[*identity.IPIdentityPair] {
+	if !cp.compactCache {
+		return nil
+	}
+
+	return endpointCodec{}
+}
+
+func (cp cparams) serviceCodec() codec[*serviceStore.ClusterService] {
+	if !cp.compactCache {
+		return nil
+	}
+
+	return serviceCodec{
+		cluster:       cp.cluster,
+		frontendPorts: cp.spec.ServiceShape.frontendPorts(),
+		backendPorts:  cp.spec.ServiceShape.backendPorts(),
+	}
+}
+
+// nodeCodec encodes the fields of the mocked nodes which are not derived from
+// the cluster and the node name.
+type nodeCodec struct {
+	cluster     cmtypes.ClusterInfo
+	annotations map[string]string
+}
+
+func (nc nodeCodec) encode(no *nodeTypes.Node) (string, bool) {
+	if no.Cluster != nc.cluster.Name || no.ClusterID != nc.cluster.ID || len(no.IPAddresses) == 0 ||
+		!maps.Equal(no.Labels, nodeLabels(no.Name)) || !sameMap(no.Annotations, nc.annotations) {
+		return "", false
+	}
+
+	// All the other fields must be unset, as not encoded.
+	rest := *no
+	rest.Name, rest.Cluster, rest.ClusterID, rest.Labels, rest.Annotations = "", "", 0, nil, nil
+	rest.EncryptionKey, rest.WireguardPubKey, rest.IPAddresses = 0, "", nil
+	rest.IPv4AllocCIDR, rest.IPv4HealthIP, rest.IPv4IngressIP = nil, nil, nil
+	rest.IPv6AllocCIDR, rest.IPv6HealthIP, rest.IPv6IngressIP = nil, nil, nil
+	if !reflect.ValueOf(rest).IsZero() {
+		return "", false
+	}
+
+	var p packer
+	p.str(no.Name)
+	p.uint(uint64(no.EncryptionKey))
+	p.str(no.WireguardPubKey)
+
+	p.uint(uint64(len(no.IPAddresses)))
+	for _, addr := range no.IPAddresses {
+		p.str(string(addr.Type))
+		p.ip(addr.IP)
+	}
+
+	p.cidr(no.IPv4AllocCIDR)
+	p.ip(no.IPv4HealthIP)
+	p.ip(no.IPv4IngressIP)
+	p.cidr(no.IPv6AllocCIDR)
+	p.ip(no.IPv6HealthIP)
+	p.ip(no.IPv6IngressIP)
+	return string(p), true
+}
+
+func (nc nodeCodec) decode(packed string) *nodeTypes.Node {
+	u := unpacker(packed)
+	no := &nodeTypes.Node{
+		Name:            u.str(),
+		Cluster:         nc.cluster.Name,
+		ClusterID:       nc.cluster.ID,
+		Annotations:     nc.annotations,
+		EncryptionKey:   uint8(u.uint()),
+		WireguardPubKey: u.str(),
+	}
+
+	no.Labels = nodeLabels(no.Name)
+	for range u.uint() {
+		no.IPAddresses = append(no.IPAddresses, nodeTypes.Address{Type: addressing.AddressType(u.str()), IP: u.ip()})
+	}
+
+	no.IPv4AllocCIDR = u.cidr()
+	no.IPv4HealthIP = u.ip()
+	no.IPv4IngressIP = u.ip()
+	no.IPv6AllocCIDR = u.cidr()
+	no.IPv6HealthIP = u.ip()
+	no.IPv6IngressIP = u.ip()
+	return no
+}
+
+// endpointCodec encodes the fields of the mocked endpoints.
+type endpointCodec struct{}
+
+func (endpointCodec) encode(ep *identity.IPIdentityPair) (string, bool) {
+	// All the other fields must be unset, as not encoded.
+	rest := *ep
+	rest.IP, rest.HostIP, rest.ID, rest.Key, rest.K8sNamespace, rest.K8sPodName = nil, nil, 0, 0, "", ""
+	if !reflect.ValueOf(rest).IsZero() {
+		return "", false
+	}
+
+	var p packer
+	p.ip(ep.IP)
+	p.ip(ep.HostIP)
+	p.uint(uint64(ep.ID))
+	p.uint(uint64(ep.Key))
+	p.str(ep.K8sNamespace)
+	p.str(ep.K8sPodName)
+	return string(p), true
+}
+
+func (endpointCodec) decode(packed string) *identity.IPIdentityPair {
+	u := unpacker(packed)
+	return &identity.IPIdentityPair{
+		IP:           u.ip(),
+		HostIP:       u.ip(),
+		ID:           identity.NumericIdentity(u.uint()),
+		Key:          uint8(u.uint()),
+		K8sNamespace: u.str(),
+		K8sPodName:   u.str(),
+	}
+}
+
+// serviceCodec encodes the fields of the mocked services which are not derived
+// from the cluster, and the addresses of the frontends and backends, while their
+// ports are derived from the service shape. The decoded services share the port
+// configurations, which are never modified.
+type serviceCodec struct {
+	cluster                     cmtypes.ClusterInfo
+	frontendPorts, backendPorts serviceStore.PortConfiguration
+}
+
+func (sc serviceCodec) encode(svc *serviceStore.ClusterService) (string, bool) {
+	if svc.Cluster != sc.cluster.Name || svc.ClusterID != sc.cluster.ID ||
+		svc.Labels == nil || !sameMap(svc.Labels, svc.Selector) ||
+		!samePorts(svc.Frontends, sc.frontendPorts) || !samePorts(svc.Backends, sc.backendPorts) {
+		return "", false
+	}
+
+	// All the other fields must be unset, as not encoded.
+	rest := *svc
+	rest.Cluster, rest.ClusterID, rest.Namespace, rest.Name = "", 0, "", ""
+	rest.Labels, rest.Selector, rest.Frontends, rest.Backends = nil, nil, nil, nil
+	rest.IncludeExternal, rest.Shared = false, false
+	if !reflect.ValueOf(rest).IsZero() {
+		return "", false
+	}
+
+	var p packer
+	p.str(svc.Namespace)
+	p.str(svc.Name)
+	p.bool(svc.IncludeExternal)
+	p.bool(svc.Shared)
+
+	p.uint(uint64(len(svc.Labels)))
+	for key, value := range svc.Labels {
+		p.str(key)
+		p.str(value)
+	}
+
+	for _, addrs := range []map[string]serviceStore.PortConfiguration{svc.Frontends, svc.Backends} {
+		p.uint(uint64(len(addrs)))
+		for ip := range addrs {
+			// The addresses must be in canonical form, to be decoded as they are.
+			addr, err := netip.ParseAddr(ip)
+			if err != nil || addr.String() != ip {
+				return "", false
+			}
+			p.str(string(addr.AsSlice()))
+		}
+	}
+
+	return string(p), true
+}
+
+func (sc serviceCodec) decode(packed string) *serviceStore.ClusterService {
+	u := unpacker(packed)
+	svc := &serviceStore.ClusterService{
+		Cluster:         sc.cluster.Name,
+		ClusterID:       sc.cluster.ID,
+		Namespace:       u.str(),
+		Name:            u.str(),
+		IncludeExternal: u.bool(),
+		Shared:          u.bool(),
+	}
+
+	n := u.uint()
+	svc.Labels, svc.Selector = make(map[string]string, n), make(map[string]string, n)
+	for range n {
+		key, value := u.str(), u.str()
+		svc.Labels[key], svc.Selector[key] = value, value
+	}
+
+	svc.Frontends = u.addrs(sc.frontendPorts)
+	svc.Backends = u.addrs(sc.backendPorts)
+	return svc
+}
+
+// samePorts returns whether all the given addresses have the given ports.
+func samePorts(addrs map[string]serviceStore.PortConfiguration, ports serviceStore.PortConfiguration) bool {
+	if addrs == nil {
+		return false
+	}
+
+	for _, got := range addrs {
+		if !got.DeepEqual(&ports) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameMap returns whether the given maps have the same content, and are either
+// both nil or not, as marshaled differently otherwise.
+func sameMap(a, b map[string]string) bool {
+	return (a == nil) == (b == nil) && maps.Equal(a, b)
+}
+
+// packer appends length-prefixed fields to a byte slice.
+type packer []byte
+
+func (p *packer) uint(v uint64) { *p = binary.AppendUvarint(*p, v) }
+
+func (p *packer) str(s string) {
+	p.uint(uint64(len(s)))
+	*p = append(*p, s...)
+}
+
+func (p *packer) bool(v bool) {
+	if v {
+		p.uint(1)
+		return
+	}
+	p.uint(0)
+}
+
+func (p *packer) ip(ip net.IP) { p.str(string(ip)) }
+
+func (p *packer) cidr(c *cidr.CIDR) {
+	if c == nil || c.IPNet == nil {
+		p.uint(0)
+		return
+	}
+
+	p.uint(1)
+	p.ip(c.IP)
+	p.ip(net.IP(c.Mask))
+}
+
+// unpacker reads the fields appended by the packer, in the same order.
+type unpacker string
+
+func (u *unpacker) uint() uint64 {
+	var v uint64
+	for shift := 0; len(*u) > 0; shift += 7 {
+		b := (*u)[0]
+		*u = (*u)[1:]
+
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			break
+		}
+	}
+	return v
+}
+
+// str returns the next string, sharing the memory with the packed representation.
+func (u *unpacker) str() string {
+	n := u.uint()
+	s := (*u)[:n]
+	*u = (*u)[n:]
+	return string(s)
+}
+
+func (u *unpacker) bool() bool { return u.uint() != 0 }
+
+func (u *unpacker) ip() net.IP {
+	if s := u.str(); s != "" {
+		return net.IP(s)
+	}
+	return nil
+}
+
+// addrs returns the next set of addresses, all associated with the given ports.
+func (u *unpacker) addrs(ports serviceStore.PortConfiguration) map[string]serviceStore.PortConfiguration {
+	n := u.uint()
+	addrs := make(map[string]serviceStore.PortConfiguration, n)
+	for range n {
+		addr, _ := netip.AddrFromSlice([]byte(u.str()))
+		addrs[addr.String()] = ports
+	}
+	return addrs
+}
+
+func (u *unpacker) cidr() *cidr.CIDR {
+	if u.uint() == 0 {
+		return nil
+	}
+
+	return &cidr.CIDR{IPNet: &net.IPNet{IP: u.ip(), Mask: net.IPMask(u.ip())}}
+}
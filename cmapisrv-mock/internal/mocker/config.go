@@ -4,10 +4,13 @@
 package mocker
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/spf13/pflag"
 
+	"github.com/cilium/cilium/pkg/defaults"
 	wgTypes "github.com/cilium/cilium/pkg/wireguard/types"
 )
 
@@ -32,15 +35,25 @@ const (
 
 type config struct {
 	EnableIPv6 bool
+	IPFamily   string
 	Encryption encryptionMode
 
 	Clusters       uint
 	FirstClusterID uint
 
+	MaxConnectedClusters uint32
+	OmitClusterConfig    bool
+
 	Nodes           uint
 	NodesQPS        float64
 	NodeAnnotations map[string]string
 
+	NodeReplacementQPS       float64
+	NodeReplacementEndpoints string
+
+	KeyRotationInterval time.Duration
+	KeyRotationQPS      float64
+
 	Identities    uint
 	IdentitiesQPS float64
 
@@ -49,6 +62,37 @@ type config struct {
 
 	Services    uint
 	ServicesQPS float64
+
+	ServiceBackendsFromEndpoints bool
+
+	ServiceExports    uint
+	ServiceExportsQPS float64
+
+	Scenario string
+
+	Consistent   bool
+	PodLifecycle bool
+
+	SyncWorkers  uint
+	CompactCache bool
+
+	Replay      string
+	ReplaySpeed float64
+
+	Snapshot string
+
+	RetryMinBackoff   time.Duration
+	RetryMaxBackoff   time.Duration
+	ErrorBudget       uint
+	ErrorBudgetWindow time.Duration
+
+	DirectMode       bool
+	DirectEtcdConfig string
+	DirectKeyPrefix  string
+
+	EmbeddedEtcd              bool
+	EmbeddedEtcdListenAddress string
+	EmbeddedEtcdDataDir       string
 }
 
 var defaultConfig = config{
@@ -58,22 +102,54 @@ var defaultConfig = config{
 	Clusters:       1,
 	FirstClusterID: 1,
 
+	MaxConnectedClusters: defaults.MaxConnectedClusters,
+
 	Nodes:      10,
 	Identities: 10,
 	Endpoints:  10,
 	Services:   10,
+
+	NodeReplacementEndpoints: string(endpointsPolicyMove),
+
+	KeyRotationQPS: 10,
+
+	SyncWorkers: 1,
+
+	ReplaySpeed: 1,
+
+	RetryMinBackoff:   100 * time.Millisecond,
+	RetryMaxBackoff:   30 * time.Second,
+	ErrorBudget:       0,
+	ErrorBudgetWindow: 5 * time.Minute,
+
+	EmbeddedEtcdListenAddress: "127.0.0.1:2379",
 }
 
 func (def config) Flags(flags *pflag.FlagSet) {
-	flags.Bool("enable-ipv6", def.EnableIPv6, "Enable IPv6")
+	flags.Bool("enable-ipv6", def.EnableIPv6, "Enable IPv6 (equivalent to --ip-family=dual)")
+	flags.String("ip-family", def.IPFamily, "IP family of the mocked addresses, taking precedence over --enable-ipv6 "+
+		"if set; supported values: ipv4|ipv6|dual")
 	flags.String("encryption", string(def.Encryption), "Cilium's encryption mode; supported values: disabled|ipsec|wireguard")
 
 	flags.Uint("clusters", def.Clusters, "Number of clusters to mock")
 	flags.Uint("first-cluster-id", def.FirstClusterID, "Cluster ID of the initial cluster")
+	flags.Uint32("max-connected-clusters", def.MaxConnectedClusters, "Maximum number of connected clusters advertised "+
+		"through the ClusterConfig (0|255|511), which also determines how the cluster ID is encoded in the mocked "+
+		"identities. Zero omits the capability, as older Cilium versions did, and implies the default encoding")
+	flags.Bool("omit-cluster-config", def.OmitClusterConfig, "Do not write the ClusterConfig of the mocked clusters, "+
+		"emulating remote clusters running very old Cilium versions")
 
 	flags.Uint("nodes", def.Nodes, "Number of nodes to mock (per cluster)")
 	flags.Float64("nodes-qps", def.NodesQPS, "Node QPS (per cluster)")
 	flags.StringToString("node-annotations", def.NodeAnnotations, "Extra annotations configured for each mocked node")
+	flags.Float64("node-replacement-qps", def.NodeReplacementQPS, "Number of nodes replaced per second, "+
+		"simulating a rolling upgrade (per cluster; disabled if zero)")
+	flags.String("node-replacement-endpoints", def.NodeReplacementEndpoints, "Whether the endpoints hosted "+
+		"on a replaced node are moved to the new node, or removed; supported values: move|remove")
+	flags.Duration("key-rotation-interval", def.KeyRotationInterval, "Interval between subsequent rotations of the "+
+		"IPsec key index, or of the WireGuard public keys, depending on the encryption mode (disabled if zero)")
+	flags.Float64("key-rotation-qps", def.KeyRotationQPS, "Number of nodes (together with the hosted endpoints, "+
+		"in case of IPsec) switched to the new key per second, during each rotation (per cluster)")
 
 	flags.Uint("identities", def.Identities, "Number of identities to mock (per cluster)")
 	flags.Float64("identities-qps", def.IdentitiesQPS, "Identities QPS (per cluster)")
@@ -83,6 +159,57 @@ func (def config) Flags(flags *pflag.FlagSet) {
 
 	flags.Uint("services", def.Endpoints, "Number of services to mock (per cluster)")
 	flags.Float64("services-qps", def.EndpointsQPS, "Services QPS (per cluster)")
+	flags.Bool("service-backends-from-endpoints", def.ServiceBackendsFromEndpoints, "Select the service backends "+
+		"among the mocked endpoints, removing them from the services when the corresponding endpoints are deleted")
+
+	flags.Uint("service-exports", def.ServiceExports, "Number of MCS-API service exports to mock, each "+
+		"corresponding to a mocked global service (per cluster)")
+	flags.Float64("service-exports-qps", def.ServiceExportsQPS, "MCS-API service exports QPS (per cluster)")
+
+	flags.String("scenario", def.Scenario, "Path to a YAML file describing the mocked clusters individually. "+
+		"Settings not specified in the file default to the values of the corresponding flags")
+
+	flags.Bool("consistent", def.Consistent, "Keep the mocked endpoints consistent with the mocked nodes and identities, "+
+		"moving or removing them before deleting the nodes and identities they refer to")
+	flags.Bool("pod-lifecycle", def.PodLifecycle, "Drive the churn of identities, endpoints and services through "+
+		"pods being started and deleted, allocating identities on demand and adding the backends to the services "+
+		"selecting them. The endpoints target and QPS correspond to the number of pods and pods per second, "+
+		"while the identities target corresponds to the number of distinct workloads (the identities QPS must be zero)")
+
+	flags.Uint("sync-workers", def.SyncWorkers, "Number of concurrent kvstore writes performed for each mocked "+
+		"cluster and resource type, to speed up the initial population of large datasets. The sync canaries "+
+		"are still written only once all the initial objects have been written")
+	flags.Bool("compact-cache", def.CompactCache, "Keep the mocked nodes, endpoints and services in memory "+
+		"in a compact representation, decoded on demand, trading CPU time for memory when mocking very large meshes "+
+		"(identities are always stored as they are)")
+
+	flags.String("replay", def.Replay, "Path to a recording (generated through the record subcommand) to be replayed "+
+		"in each mocked cluster, instead of generating random churn")
+	flags.Float64("replay-speed", def.ReplaySpeed, "Speed factor applied to the original timing of the replayed events")
+
+	flags.String("snapshot", def.Snapshot, "Path to a snapshot (exported through the control API) the initial "+
+		"state of the mocked clusters is loaded from, in place of randomly generated objects")
+
+	flags.Duration("retry-min-backoff", def.RetryMinBackoff, "Minimum backoff before retrying a failed kvstore operation")
+	flags.Duration("retry-max-backoff", def.RetryMaxBackoff, "Maximum backoff before retrying a failed kvstore operation")
+	flags.Uint("error-budget", def.ErrorBudget, "Number of failed kvstore operations tolerated within the error "+
+		"budget window, before giving up (unlimited if zero)")
+	flags.Duration("error-budget-window", def.ErrorBudgetWindow, "Sliding window the error budget refers to")
+
+	flags.Bool("direct-mode", def.DirectMode, "Mock the clusters as served directly by plain clustermesh-apiservers, "+
+		"writing to the non-cached prefixes, rather than through KVStoreMesh")
+	flags.String("direct-etcd-config", def.DirectEtcdConfig, "Path template of the etcd configuration file of each "+
+		"cluster in direct mode, where "+clusterPlaceholder+" expands to the cluster name (defaults to the main kvstore)")
+	flags.String("direct-key-prefix", def.DirectKeyPrefix, "Template of the prefix prepended to all keys of each "+
+		"cluster in direct mode, where "+clusterPlaceholder+" expands to the cluster name, for use with etcd gRPC "+
+		"proxies configured with the matching namespace")
+
+	flags.Bool("embedded-etcd", def.EmbeddedEtcd, "Run an embedded, single-member etcd server in-process, and "+
+		"write the mocked data to it, rather than connecting to an external etcd")
+	flags.String("embedded-etcd-listen-address", def.EmbeddedEtcdListenAddress, "Address the embedded etcd "+
+		"server listens on for client requests, e.g., from agents, KVStoreMesh and etcdctl")
+	flags.String("embedded-etcd-data-dir", def.EmbeddedEtcdDataDir, "Data directory of the embedded etcd server "+
+		"(defaults to a temporary directory, removed on termination)")
 }
 
 func (cfg config) validate() error {
@@ -92,10 +219,66 @@ func (cfg config) validate() error {
 		return fmt.Errorf("unsupported encryption mode %q; must be one of disabled|ipsec|wireguard", cfg.Encryption)
 	}
 
+	if cfg.IPFamily != "" {
+		if err := ipFamily(cfg.IPFamily).validate(); err != nil {
+			return err
+		}
+	}
+
+	replacement := nodeReplacement{QPS: cfg.NodeReplacementQPS, Endpoints: endpointsPolicy(cfg.NodeReplacementEndpoints)}
+	if err := replacement.validate(); err != nil {
+		return err
+	}
+
+	rotation := keyRotation{Interval: duration(cfg.KeyRotationInterval), QPS: cfg.KeyRotationQPS}
+	if err := rotation.validate(); err != nil {
+		return err
+	}
+
+	if err := validateMaxConnectedClusters(cfg.MaxConnectedClusters); err != nil {
+		return err
+	}
+
+	if cfg.SyncWorkers == 0 {
+		return errors.New("the number of sync workers must be positive")
+	}
+
+	if cfg.ReplaySpeed <= 0 {
+		return fmt.Errorf("invalid replay speed %v: must be positive", cfg.ReplaySpeed)
+	}
+
+	if cfg.RetryMinBackoff <= 0 || cfg.RetryMaxBackoff < cfg.RetryMinBackoff {
+		return errors.New("retry backoffs must be positive, and the maximum one must not be lower than the minimum")
+	}
+
+	if cfg.ErrorBudgetWindow <= 0 {
+		return errors.New("error budget window must be positive")
+	}
+
+	if cfg.Replay != "" && cfg.Snapshot != "" {
+		return errors.New("replay and snapshot are mutually exclusive")
+	}
+
+	if cfg.PodLifecycle && (cfg.Replay != "" || cfg.Snapshot != "") {
+		return errors.New("the pod lifecycle mode is not supported together with replay and snapshots")
+	}
+
+	if !cfg.DirectMode && (cfg.DirectEtcdConfig != "" || cfg.DirectKeyPrefix != "") {
+		return errors.New("per-cluster etcd configurations and key prefixes require direct mode")
+	}
+
 	return nil
 }
 
+// dedicatedBackends returns whether each cluster is associated with a dedicated
+// backend, that is a separate etcd instance or key prefix, in direct mode.
+func (cfg config) dedicatedBackends() bool {
+	return cfg.DirectMode && (cfg.DirectEtcdConfig != "" || cfg.DirectKeyPrefix != "")
+}
+
 type rndcfg struct {
+	Seed int64
+
 	RandomNodeIP4 string
 	RandomNodeIP6 string
 	RandomPodIP4  string
@@ -114,6 +297,9 @@ var defaultRndcfg = rndcfg{
 }
 
 func (def rndcfg) Flags(flags *pflag.FlagSet) {
+	flags.Int64("seed", def.Seed, "Seed driving all random decisions, to reproduce the same sequence of operations "+
+		"given the same configuration (a random one is selected and logged if zero)")
+
 	flags.String("random-node-ip4", def.RandomNodeIP4, "The first mocked node IPv4 address")
 	flags.String("random-node-ip6", def.RandomNodeIP6, "The first mocked node IPv6 address")
 
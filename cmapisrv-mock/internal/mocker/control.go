@@ -0,0 +1,375 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/cilium/cilium/clustermesh-apiserver/health"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+)
+
+// control holds the run-time tunable parameters of a syncer.
+type control struct {
+	mu      lock.RWMutex
+	target  uint
+	qps     rate.Limit
+	profile profile
+	started time.Time
+	paused  bool
+	changed chan struct{}
+
+	// holds is the number of operations (e.g., audits) currently suspending
+	// the churn, independently of the paused setting.
+	holds uint
+	// steps is read-locked while performing each step of the churn, so that
+	// holding it waits for the in-flight ones to complete.
+	steps lock.RWMutex
+	// passive is set if the objects are written only on behalf of other types,
+	// hence there's no churn, and the QPS cannot be tuned.
+	passive bool
+
+	size func() uint
+}
+
+type controlState struct {
+	target  uint
+	qps     rate.Limit
+	dynamic bool
+	paused  bool
+	changed <-chan struct{}
+}
+
+func newControl(res resource, size func() uint) *control {
+	return &control{
+		target:  res.Target,
+		qps:     rate.Limit(res.QPS),
+		profile: res.Profile,
+		changed: make(chan struct{}),
+		size:    size,
+	}
+}
+
+// start marks the beginning of the churn phase, which is the reference
+// instant for the time-varying churn profiles.
+func (c *control) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.started = time.Now()
+}
+
+// state returns the current parameters, and a channel which is closed when
+// any of them gets modified. The returned QPS is already modulated according
+// to the churn profile, if the churn phase already started.
+func (c *control) state() controlState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	qps := c.qps
+	if !c.started.IsZero() {
+		qps *= rate.Limit(c.profile.factor(time.Since(c.started)))
+	}
+
+	return controlState{target: c.target, qps: qps, dynamic: c.profile.dynamic(),
+		paused: c.paused || c.holds > 0, changed: c.changed}
+}
+
+// hold suspends the churn until the returned function is invoked, regardless
+// of the paused setting. It returns once the in-flight steps completed.
+func (c *control) hold() (release func()) {
+	c.update(func(c *control) { c.holds++ })
+	c.steps.Lock()
+	c.steps.Unlock()
+	return func() { c.update(func(c *control) { c.holds-- }) }
+}
+
+// step performs a step of the churn through fn, and returns true, unless it
+// is currently paused or held.
+func (c *control) step(fn func()) bool {
+	c.steps.RLock()
+	defer c.steps.RUnlock()
+
+	if c.state().paused {
+		return false
+	}
+
+	fn()
+	return true
+}
+
+// stepWhenResumed blocks until the churn is neither paused nor held, and then
+// performs a step of it through fn, or until the context is canceled.
+func (c *control) stepWhenResumed(ctx context.Context, fn func()) error {
+	for {
+		st := c.state()
+		if !st.paused && c.step(fn) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-st.changed:
+		}
+	}
+}
+
+func (c *control) update(fn func(c *control)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fn(c)
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *control) status() resourceStatus {
+	st := c.state()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return resourceStatus{
+		Target:       st.target,
+		QPS:          float64(c.qps),
+		EffectiveQPS: float64(st.qps),
+		Profile:      c.profile.Type,
+		Paused:       st.paused,
+		Current:      c.size(),
+	}
+}
+
+type resourceStatus struct {
+	Target       uint        `json:"target"`
+	QPS          float64     `json:"qps"`
+	EffectiveQPS float64     `json:"effectiveQPS"`
+	Profile      profileType `json:"profile,omitempty"`
+	Paused       bool        `json:"paused"`
+	Current      uint        `json:"current"`
+}
+
+type clusterStatus struct {
+	Name      string                    `json:"name"`
+	ID        uint32                    `json:"id"`
+	Connected bool                      `json:"connected"`
+	Resources map[string]resourceStatus `json:"resources,omitempty"`
+	Faults    []faultType               `json:"faults,omitempty"`
+}
+
+type resourceUpdate struct {
+	Target *uint    `json:"target,omitempty"`
+	QPS    *float64 `json:"qps,omitempty"`
+}
+
+// controlEndpoints returns the HTTP endpoints to inspect, tune, connect and
+// disconnect the mocked clusters at run-time. The tuning endpoints support the
+// optional "cluster" and "type" query parameters, to restrict the scope of the
+// operation to the given cluster and resource type respectively.
+func (mk *mocker) controlEndpoints() []health.EndpointFunc {
+	return []health.EndpointFunc{
+		{
+			Path: "GET /clusters",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				mk.reply(w, r, http.StatusOK, mk.cls.status())
+			},
+		},
+		{
+			Path:        "GET /clusters/audit",
+			HandlerFunc: mk.audit,
+		},
+		{
+			Path:        "GET /clusters/snapshot",
+			HandlerFunc: mk.snapshot,
+		},
+		{
+			Path:        "GET /errors",
+			HandlerFunc: mk.kvstoreErrors,
+		},
+		{
+			Path: "PATCH /clusters",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				var upd resourceUpdate
+				if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
+					mk.reply(w, r, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err))
+					return
+				}
+
+				if upd.QPS != nil && *upd.QPS < 0 {
+					mk.reply(w, r, http.StatusBadRequest, "qps must not be negative")
+					return
+				}
+
+				check := func(c *control) error {
+					if upd.QPS != nil && c.passive {
+						return errors.New("qps cannot be tuned for this type")
+					}
+					return nil
+				}
+
+				mk.tune(w, r, check, func(c *control) {
+					if upd.Target != nil {
+						c.target = *upd.Target
+					}
+					// The QPS of passive types is left untouched when tuning all types.
+					if upd.QPS != nil && !c.passive {
+						c.qps = rate.Limit(*upd.QPS)
+					}
+				})
+			},
+		},
+		{
+			Path: "POST /clusters/pause",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				mk.tune(w, r, nil, func(c *control) { c.paused = true })
+			},
+		},
+		{
+			Path: "POST /clusters/resume",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				mk.tune(w, r, nil, func(c *control) { c.paused = false })
+			},
+		},
+		{
+			Path: "POST /clusters/{cluster}/connect",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				mk.connection(w, r, func(name string) error { return mk.cls.Connect(name) })
+			},
+		},
+		{
+			Path: "POST /clusters/{cluster}/disconnect",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				mk.connection(w, r, func(name string) error { return mk.cls.Disconnect(r.Context(), name) })
+			},
+		},
+		{
+			Path: "POST /clusters/{cluster}/faults/{fault}",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				mk.fault(w, r, mk.cls.Inject)
+			},
+		},
+		{
+			Path: "DELETE /clusters/{cluster}/faults/{fault}",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
+				mk.fault(w, r, mk.cls.Clear)
+			},
+		},
+	}
+}
+
+func (mk *mocker) fault(w http.ResponseWriter, r *http.Request, fn func(ctx context.Context, name string, typ faultType) error) {
+	name, typ := r.PathValue("cluster"), faultType(r.PathValue("fault"))
+	if err := typ.validate(); err != nil {
+		mk.reply(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	switch err := fn(r.Context(), name, typ); {
+	case errors.Is(err, errClusterNotFound):
+		mk.reply(w, r, http.StatusNotFound, fmt.Sprintf("cluster %q not found", name))
+	case errors.Is(err, errHeartbeatShared):
+		mk.reply(w, r, http.StatusBadRequest, fmt.Sprintf("cluster %q: %s", name, err))
+	case errors.Is(err, errFaultInjected), errors.Is(err, errFaultCleared):
+		mk.reply(w, r, http.StatusConflict, fmt.Sprintf("cluster %q: %s: %s", name, typ, err))
+	case err != nil:
+		mk.reply(w, r, http.StatusInternalServerError, fmt.Sprintf("cluster %q: %s", name, err))
+	default:
+		mk.log.Info("Modified injected faults at run-time",
+			logfields.Request, r.Method+" "+r.URL.String(),
+		)
+		mk.reply(w, r, http.StatusOK, mk.cls.status())
+	}
+}
+
+func (mk *mocker) connection(w http.ResponseWriter, r *http.Request, fn func(name string) error) {
+	name := r.PathValue("cluster")
+
+	switch err := fn(name); {
+	case errors.Is(err, errClusterNotFound):
+		mk.reply(w, r, http.StatusNotFound, fmt.Sprintf("cluster %q not found", name))
+	case errors.Is(err, errClusterConnected), errors.Is(err, errClusterDisconnected):
+		mk.reply(w, r, http.StatusConflict, fmt.Sprintf("cluster %q: %s", name, err))
+	case err != nil:
+		mk.reply(w, r, http.StatusInternalServerError, fmt.Sprintf("cluster %q: %s", name, err))
+	default:
+		mk.log.Info("Modified mocked clusters connectivity at run-time",
+			logfields.Request, r.Method+" "+r.URL.String(),
+		)
+		mk.reply(w, r, http.StatusOK, mk.cls.status())
+	}
+}
+
+// tune applies fn to the controls selected by the cluster and type query
+// parameters. If set, check validates beforehand the controls of the type
+// explicitly requested, if any.
+func (mk *mocker) tune(w http.ResponseWriter, r *http.Request, check func(c *control) error, fn func(c *control)) {
+	var (
+		name   = r.URL.Query().Get("cluster")
+		typ    = r.URL.Query().Get("type")
+		status []clusterStatus
+	)
+
+	if alias, ok := resourceTypeAliases[typ]; ok {
+		typ = alias
+	}
+
+	if typ != "" && !slices.Contains(resourceTypes, typ) {
+		mk.reply(w, r, http.StatusBadRequest, fmt.Sprintf("unknown type %q; must be one of %s", typ, strings.Join(resourceTypes, "|")))
+		return
+	}
+
+	for _, cl := range mk.cls.list() {
+		ctrl, ok := cl.controls()[typ]
+		if check == nil || !ok || (name != "" && name != cl.cinfo.Name) {
+			continue
+		}
+
+		if err := check(ctrl); err != nil {
+			mk.reply(w, r, http.StatusBadRequest, fmt.Sprintf("cluster %q, type %q: %s", cl.cinfo.Name, typ, err))
+			return
+		}
+	}
+
+	for _, cl := range mk.cls.list() {
+		if name != "" && name != cl.cinfo.Name {
+			continue
+		}
+
+		for rtyp, ctrl := range cl.controls() {
+			if typ == "" || typ == rtyp {
+				ctrl.update(fn)
+			}
+		}
+
+		status = append(status, cl.status())
+	}
+
+	if len(status) == 0 {
+		mk.reply(w, r, http.StatusNotFound, fmt.Sprintf("cluster %q not found", name))
+		return
+	}
+
+	mk.log.Info("Tuned mocked clusters at run-time",
+		logfields.Request, r.Method+" "+r.URL.String(),
+	)
+	mk.reply(w, r, http.StatusOK, status)
+}
+
+func (mk *mocker) reply(w http.ResponseWriter, r *http.Request, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		mk.log.Error("Failed to respond to request", logfields.Error, err, logfields.URL, r.URL)
+	}
+}
@@ -0,0 +1,344 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+
+	"sigs.k8s.io/yaml"
+
+	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	nodeTypes "github.com/cilium/cilium/pkg/node/types"
+)
+
+// datasetVersion is the version of the dataset snapshot format. It must be
+// bumped whenever the format changes in a backward incompatible way.
+const datasetVersion = 1
+
+// dataset is a snapshot of the objects mocked for each cluster, which can be
+// exported at run-time, and subsequently loaded as the initial state of the
+// mocked clusters, in place of randomly generated objects.
+type dataset struct {
+	// Version is the version of the snapshot format.
+	Version int `json:"version"`
+	// Clusters are the snapshots of the individual clusters.
+	Clusters []clusterDataset `json:"clusters"`
+}
+
+type clusterDataset struct {
+	Name string `json:"name"`
+	ID   uint32 `json:"id"`
+
+	Nodes      []*nodeTypes.Node              `json:"nodes"`
+	Identities []identityDataset              `json:"identities"`
+	Endpoints  []*identity.IPIdentityPair     `json:"endpoints"`
+	Services   []*serviceStore.ClusterService `json:"services"`
+
+	ServiceExports []*serviceExport `json:"serviceExports,omitempty"`
+}
+
+type identityDataset struct {
+	ID identity.NumericIdentity `json:"id"`
+	// Labels are the identity labels, in the kvstore format.
+	Labels string `json:"labels"`
+}
+
+// newDataset reads the dataset snapshot to be loaded, if configured, and
+// checks that it matches the mocked clusters.
+func newDataset(cfg config, specs []clusterSpec) (*dataset, error) {
+	if cfg.Snapshot == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(cfg.Snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	// Unknown fields are tolerated, so that snapshots can be loaded by
+	// mockers built against different Cilium versions.
+	var ds dataset
+	if err := yaml.Unmarshal(data, &ds); err != nil {
+		return nil, fmt.Errorf("parsing snapshot %q: %w", cfg.Snapshot, err)
+	}
+
+	if err := ds.validate(specs); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %q: %w", cfg.Snapshot, err)
+	}
+
+	return &ds, nil
+}
+
+func (ds *dataset) validate(specs []clusterSpec) error {
+	if ds.Version != datasetVersion {
+		return fmt.Errorf("unsupported version %d; must be %d", ds.Version, datasetVersion)
+	}
+
+	ids := make(map[string]uint32, len(specs))
+	for _, spec := range specs {
+		ids[spec.Name] = spec.ID
+	}
+
+	seen := make(map[string]struct{}, len(ds.Clusters))
+	for _, cd := range ds.Clusters {
+		id, ok := ids[cd.Name]
+		switch {
+		case !ok:
+			return fmt.Errorf("cluster %q is not mocked", cd.Name)
+		case id != cd.ID:
+			return fmt.Errorf("cluster %q: ID %d does not match the mocked one (%d)", cd.Name, cd.ID, id)
+		}
+
+		if _, ok := seen[cd.Name]; ok {
+			return fmt.Errorf("duplicate cluster %q", cd.Name)
+		}
+		seen[cd.Name] = struct{}{}
+
+		if len(cd.Endpoints) > 0 && (len(cd.Nodes) == 0 || len(cd.Identities) == 0) {
+			return fmt.Errorf("cluster %q: endpoints require at least one node and one identity", cd.Name)
+		}
+
+		for _, endpoint := range cd.Endpoints {
+			if endpoint.IP == nil {
+				return fmt.Errorf("cluster %q: endpoints must have an IP address", cd.Name)
+			}
+		}
+
+		for _, export := range cd.ServiceExports {
+			if !slices.ContainsFunc(cd.Services, func(svc *serviceStore.ClusterService) bool {
+				return svc.Namespace == export.Namespace && svc.Name == export.Name
+			}) {
+				return fmt.Errorf("cluster %q: service export %s/%s does not match any service",
+					cd.Name, export.Namespace, export.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// cluster returns the snapshot of the given cluster, if present.
+func (ds *dataset) cluster(name string) *clusterDataset {
+	if ds == nil {
+		return nil
+	}
+
+	for i := range ds.Clusters {
+		if ds.Clusters[i].Name == name {
+			return &ds.Clusters[i]
+		}
+	}
+
+	return nil
+}
+
+// reservations returns the addresses and prefixes used by the objects in the
+// snapshot, which must not be allocated again to new objects.
+func (cd *clusterDataset) reservations() *reservations {
+	res := newReservations()
+
+	for _, node := range cd.Nodes {
+		for _, address := range node.IPAddresses {
+			res.addIP(address.IP)
+		}
+
+		res.addIP(node.IPv4HealthIP, node.IPv6HealthIP, node.IPv4IngressIP, node.IPv6IngressIP)
+		if node.IPv4AllocCIDR != nil {
+			res.addPrefix(node.IPv4AllocCIDR.IPNet)
+		}
+		if node.IPv6AllocCIDR != nil {
+			res.addPrefix(node.IPv6AllocCIDR.IPNet)
+		}
+	}
+
+	for _, endpoint := range cd.Endpoints {
+		res.addIP(endpoint.IP)
+	}
+
+	for _, service := range cd.Services {
+		for _, ips := range []map[string]serviceStore.PortConfiguration{service.Frontends, service.Backends} {
+			for ip := range ips {
+				if parsed, err := netip.ParseAddr(ip); err == nil {
+					res.addrs[parsed] = struct{}{}
+				}
+			}
+		}
+	}
+
+	return res
+}
+
+// load populates the caches with the objects in the snapshot, and configures
+// the syncers to write them to the kvstore in place of random objects during
+// the initial synchronization.
+func (cl *cluster) load(cd *clusterDataset) {
+	for _, node := range cd.Nodes {
+		cl.nodes.cache.Upsert(node)
+	}
+
+	for _, id := range cd.Identities {
+		cl.identities.cache.Upsert(store.NewKVPair(strconv.FormatUint(uint64(id.ID), 10), id.Labels))
+	}
+
+	for _, endpoint := range cd.Endpoints {
+		cl.endpoints.cache.Upsert(endpoint)
+	}
+
+	for _, service := range cd.Services {
+		cl.services.cache.Upsert(service)
+	}
+
+	for _, export := range cd.ServiceExports {
+		cl.exports.cache.Upsert(export)
+	}
+
+	// Retrieve the objects back from the caches, to get rid of duplicates.
+	cl.nodes.initial = cached(&cl.nodes.cache)
+	cl.identities.initial = cached(&cl.identities.cache)
+	cl.endpoints.initial = cached(&cl.endpoints.cache)
+	cl.services.initial = cached(&cl.services.cache)
+	cl.exports.initial = cached(&cl.exports.cache)
+
+	cl.log.Info("Loaded initial state from snapshot",
+		"nodes", len(cl.nodes.initial), "identities", len(cl.identities.initial),
+		"endpoints", len(cl.endpoints.initial), "services", len(cl.services.initial),
+		"serviceexports", len(cl.exports.initial))
+}
+
+// export returns the snapshot of the objects currently mocked for the cluster.
+func (cl *cluster) export() clusterDataset {
+	cd := clusterDataset{
+		Name:      cl.cinfo.Name,
+		ID:        cl.cinfo.ID,
+		Nodes:     cached(&cl.nodes.cache),
+		Endpoints: cached(&cl.endpoints.cache),
+		Services:  cached(&cl.services.cache),
+
+		ServiceExports: cached(&cl.exports.cache),
+	}
+
+	cd.Identities = make([]identityDataset, 0, cl.identities.cache.Len())
+	for _, kv := range cached(&cl.identities.cache) {
+		cd.Identities = append(cd.Identities, identityDataset{ID: cl.identities.parse(kv), Labels: string(kv.Value)})
+	}
+
+	return cd
+}
+
+// cached returns all the objects in the cache, as a non-nil slice.
+func cached[T store.Key](c *cache[T]) []T {
+	return append(make([]T, 0, c.Len()), c.Select(func(T) bool { return true })...)
+}
+
+// snapshot handles the requests to export the objects currently mocked for
+// each cluster, optionally restricted to the given cluster, in JSON (default)
+// or YAML format.
+func (mk *mocker) snapshot(w http.ResponseWriter, r *http.Request) {
+	var (
+		name   = r.URL.Query().Get("cluster")
+		format = r.URL.Query().Get("format")
+		ds     = dataset{Version: datasetVersion}
+	)
+
+	if format != "" && format != "json" && format != "yaml" {
+		mk.reply(w, r, http.StatusBadRequest, fmt.Sprintf("unsupported format %q; must be one of json|yaml", format))
+		return
+	}
+
+	for _, cl := range mk.cls.list() {
+		if name != "" && name != cl.cinfo.Name {
+			continue
+		}
+
+		// The objects replayed from a recording are not tracked.
+		if cl.replay == nil {
+			ds.Clusters = append(ds.Clusters, cl.export())
+		}
+	}
+
+	if len(ds.Clusters) == 0 {
+		mk.reply(w, r, http.StatusNotFound, fmt.Sprintf("cluster %q not found", name))
+		return
+	}
+
+	if format != "yaml" {
+		mk.reply(w, r, http.StatusOK, ds)
+		return
+	}
+
+	data, err := yaml.Marshal(ds)
+	if err != nil {
+		mk.log.Error("Failed to marshal snapshot", logfields.Error, err)
+		mk.reply(w, r, http.StatusInternalServerError, fmt.Sprintf("marshaling snapshot: %s", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		mk.log.Error("Failed to respond to request", logfields.Error, err, logfields.URL, r.URL)
+	}
+}
+
+// reservations are the addresses and prefixes already in use, which must not
+// be allocated again. They are not modified after creation, hence they can be
+// shared by multiple allocators without synchronization.
+type reservations struct {
+	addrs    map[netip.Addr]struct{}
+	prefixes map[netip.Prefix]struct{}
+}
+
+func newReservations() *reservations {
+	return &reservations{
+		addrs:    make(map[netip.Addr]struct{}),
+		prefixes: make(map[netip.Prefix]struct{}),
+	}
+}
+
+func (res *reservations) addIP(ips ...net.IP) {
+	for _, ip := range ips {
+		if parsed, ok := netip.AddrFromSlice(ip); ok {
+			res.addrs[parsed.Unmap()] = struct{}{}
+		}
+	}
+}
+
+func (res *reservations) addPrefix(ipnet *net.IPNet) {
+	if ipnet == nil {
+		return
+	}
+
+	addr, ok := netip.AddrFromSlice(ipnet.IP)
+	ones, _ := ipnet.Mask.Size()
+	if ok {
+		res.prefixes[netip.PrefixFrom(addr.Unmap(), ones)] = struct{}{}
+	}
+}
+
+func (res *reservations) hasAddr(addr netip.Addr) bool {
+	if res == nil {
+		return false
+	}
+
+	_, ok := res.addrs[addr]
+	return ok
+}
+
+func (res *reservations) hasPrefix(pfx netip.Prefix) bool {
+	if res == nil {
+		return false
+	}
+
+	_, ok := res.prefixes[pfx]
+	return ok
+}
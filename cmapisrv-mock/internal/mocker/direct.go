@@ -0,0 +1,236 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cilium/cilium/pkg/defaults"
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+)
+
+// github.com/cilium/cilium/pkg/ipcache.AddressSpace
+const addressSpace = "default"
+
+// clusterPlaceholder is replaced with the cluster name in the templates of the
+// per-cluster etcd configurations and key prefixes.
+const clusterPlaceholder = "{cluster}"
+
+// layout determines the keys the objects of the mocked clusters are written
+// to, depending on whether they are cached by KVStoreMesh (default), or served
+// directly by a plain clustermesh-apiserver.
+type layout struct {
+	direct bool
+}
+
+// prefix returns the prefix of the given resource type.
+func (l layout) prefix(base string) string {
+	if l.direct {
+		return base
+	}
+
+	return kvstore.StateToCachePrefix(base)
+}
+
+// identities returns the prefix of the identities of the given cluster. Plain
+// clustermesh-apiservers only serve the identities of the local cluster, hence
+// they are not scoped by cluster name.
+func (l layout) identities(cluster string) string {
+	if l.direct {
+		return path.Join(IdentitiesPath, "id")
+	}
+
+	return path.Join(l.prefix(IdentitiesPath), cluster, "id")
+}
+
+// endpoints returns the prefix of the endpoints of the given cluster. Plain
+// clustermesh-apiservers store them in the default address space, rather than
+// scoping them by cluster name.
+func (l layout) endpoints(cluster string) string {
+	if l.direct {
+		return path.Join(IPIdentitiesPath, addressSpace)
+	}
+
+	return path.Join(l.prefix(IPIdentitiesPath), cluster)
+}
+
+// expand replaces the cluster placeholder in the given template.
+func expand(template, cluster string) string {
+	return strings.ReplaceAll(template, clusterPlaceholder, cluster)
+}
+
+// connect establishes the connections to the per-cluster etcd instances, and
+// configures the per-cluster key prefixes, if so configured in direct mode.
+// The clusters not configured otherwise share the main backend.
+func (cls *clusters) connect(ctx context.Context) error {
+	if !cls.cfg.dedicatedBackends() {
+		return nil
+	}
+
+	for _, spec := range cls.specs {
+		backend := cls.raw
+		if cls.cfg.DirectEtcdConfig != "" {
+			var err error
+			if backend, err = cls.dial(ctx, expand(cls.cfg.DirectEtcdConfig, spec.Name)); err != nil {
+				return fmt.Errorf("connecting to etcd for cluster %q: %w", spec.Name, err)
+			}
+
+			cls.closers = append(cls.closers, backend.Close)
+		}
+
+		if cls.cfg.DirectKeyPrefix != "" {
+			backend = newPrefixedBackend(backend, expand(cls.cfg.DirectKeyPrefix, spec.Name))
+		}
+
+		backend = newRetryingBackend(cls.log, backend, cls.errs)
+		cls.backends[spec.Name] = backend
+
+		// Agents connecting to the clustermesh-apiserver of each cluster
+		// expect the heartbeat key to be periodically updated.
+		cls.wg.Add(1)
+		go func() {
+			defer cls.wg.Done()
+			writeHeartbeat(ctx, backend, cls.faults[spec.Name])
+		}()
+	}
+
+	return nil
+}
+
+// dial establishes a new connection to the etcd instance described by the
+// given configuration file, inheriting the remaining kvstore options.
+func (cls *clusters) dial(ctx context.Context, config string) (kvstore.BackendOperations, error) {
+	opts := maps.Clone(cls.kvcfg.KVStoreOpt)
+	if opts == nil {
+		opts = make(map[string]string)
+	}
+
+	delete(opts, kvstore.EtcdAddrOption)
+	opts[kvstore.EtcdOptionConfig] = config
+
+	// The etcd module configuration is global, hence the clients must be
+	// created sequentially.
+	backend, errCh := kvstore.NewClient(ctx, cls.log.With(logfields.ConfigPath, config), kvstore.EtcdBackendName, opts,
+		kvstore.ExtraOptions{LeaseTTL: cls.kvcfg.KVStoreLeaseTTL, MaxConsecutiveQuorumErrors: cls.kvcfg.KVstoreMaxConsecutiveQuorumErrors})
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			if backend != nil {
+				backend.Close()
+			}
+			return nil, err
+		}
+	case <-ctx.Done():
+		if backend != nil {
+			backend.Close()
+		}
+		return nil, ctx.Err()
+	}
+
+	// The etcdinit container grants the remote user access to the cached
+	// prefixes only, while agents read the non-cached ones in direct mode.
+	if mgmt, ok := backend.(kvstore.BackendOperationsUserMgmt); ok {
+		if err := mgmt.UserEnforcePresence(ctx, "remote", []string{"local", "remote"}); err != nil {
+			cls.log.Warn("Failed to configure remote user", logfields.Error, err, logfields.ConfigPath, config)
+		}
+	}
+
+	return backend, nil
+}
+
+// backendFor returns the backend associated with the given cluster.
+func (cls *clusters) backendFor(name string) kvstore.BackendOperations {
+	if backend, ok := cls.backends[name]; ok {
+		return backend
+	}
+
+	return cls.backend
+}
+
+// writeHeartbeat periodically updates the heartbeat key, until the context is
+// canceled. The updates are suspended while the heartbeat fault is injected
+// into the given cluster, if any, and resumed immediately once cleared.
+func writeHeartbeat(ctx context.Context, backend kvstore.BackendOperations, f *faults) {
+	for {
+		stopped, changed := f.heartbeat()
+		if !stopped {
+			tctx, cancel := context.WithTimeout(ctx, defaults.LockLeaseTTL)
+			backend.Update(tctx, kvstore.HeartbeatPath, []byte(time.Now().Format(time.RFC3339)), true)
+			cancel()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-time.After(kvstore.HeartbeatWriteInterval):
+		}
+	}
+}
+
+// prefixedBackend wraps a kvstore backend, prepending the given prefix to all
+// keys, so that each cluster can be served through a dedicated etcd gRPC proxy
+// configured with the matching namespace. Only the operations performed by the
+// mocker are supported.
+type prefixedBackend struct {
+	kvstore.BackendOperations
+
+	prefix string
+}
+
+func newPrefixedBackend(backend kvstore.BackendOperations, prefix string) kvstore.BackendOperations {
+	return &prefixedBackend{BackendOperations: backend, prefix: prefix}
+}
+
+func (pb *prefixedBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	return pb.BackendOperations.Get(ctx, pb.prefix+key)
+}
+
+func (pb *prefixedBackend) Update(ctx context.Context, key string, value []byte, lease bool) error {
+	return pb.BackendOperations.Update(ctx, pb.prefix+key, value, lease)
+}
+
+func (pb *prefixedBackend) UpdateIfDifferent(ctx context.Context, key string, value []byte, lease bool) (bool, error) {
+	return pb.BackendOperations.UpdateIfDifferent(ctx, pb.prefix+key, value, lease)
+}
+
+func (pb *prefixedBackend) Delete(ctx context.Context, key string) error {
+	return pb.BackendOperations.Delete(ctx, pb.prefix+key)
+}
+
+func (pb *prefixedBackend) DeletePrefix(ctx context.Context, path string) error {
+	return pb.BackendOperations.DeletePrefix(ctx, pb.prefix+path)
+}
+
+func (pb *prefixedBackend) ListPrefix(ctx context.Context, prefix string) (kvstore.KeyValuePairs, error) {
+	kvs, err := pb.BackendOperations.ListPrefix(ctx, pb.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(kvstore.KeyValuePairs, len(kvs))
+	for key, value := range kvs {
+		out[strings.TrimPrefix(key, pb.prefix)] = value
+	}
+
+	return out, nil
+}
+
+func (pb *prefixedBackend) RegisterLeaseExpiredObserver(prefix string, fn func(key string)) {
+	if fn == nil {
+		pb.BackendOperations.RegisterLeaseExpiredObserver(pb.prefix+prefix, nil)
+		return
+	}
+
+	pb.BackendOperations.RegisterLeaseExpiredObserver(pb.prefix+prefix, func(key string) {
+		fn(strings.TrimPrefix(key, pb.prefix))
+	})
+}
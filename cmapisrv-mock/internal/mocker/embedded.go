@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cilium/hive/cell"
+	"go.etcd.io/etcd/server/v3/embed"
+
+	"github.com/cilium/cilium/pkg/kvstore"
+)
+
+// embeddedEtcdStartTimeout is the maximum time to wait for the embedded etcd
+// server to become ready to serve client requests.
+const embeddedEtcdStartTimeout = time.Minute
+
+// embeddedEtcd runs a single-member etcd server in-process, so that the mocker
+// can be run without any external dependency, while the mocked data can still
+// be accessed by agents, KVStoreMesh and etcdctl through the client URL.
+type embeddedEtcd struct {
+	log     *slog.Logger
+	address string
+	dir     string
+
+	temporary bool
+	etcd      *embed.Etcd
+}
+
+// embeddedEtcdConfig starts the embedded etcd server, if so configured, and
+// points the regular etcd client to its client URL. The server is started
+// before the client attempts to connect, as the corresponding hook is appended
+// while constructing the client.
+func embeddedEtcdConfig(lc cell.Lifecycle, log *slog.Logger, cfg kvstore.Config, mcfg config) kvstore.Config {
+	if !mcfg.EmbeddedEtcd {
+		return cfg
+	}
+
+	ee := &embeddedEtcd{log: log, address: mcfg.EmbeddedEtcdListenAddress, dir: mcfg.EmbeddedEtcdDataDir}
+	lc.Append(ee)
+
+	cfg.KVStore = kvstore.EtcdBackendName
+	cfg.KVStoreOpt = maps.Clone(cfg.KVStoreOpt)
+	if cfg.KVStoreOpt == nil {
+		cfg.KVStoreOpt = make(map[string]string)
+	}
+
+	cfg.KVStoreOpt[kvstore.EtcdAddrOption] = ee.clientURL().String()
+	delete(cfg.KVStoreOpt, kvstore.EtcdOptionConfig)
+	return cfg
+}
+
+func (ee *embeddedEtcd) clientURL() *url.URL {
+	return &url.URL{Scheme: "http", Host: ee.address}
+}
+
+func (ee *embeddedEtcd) Start(ctx cell.HookContext) (err error) {
+	if ee.dir == "" {
+		if ee.dir, err = os.MkdirTemp("", "cmapisrv-mock-etcd-"); err != nil {
+			return fmt.Errorf("creating etcd data directory: %w", err)
+		}
+		ee.temporary = true
+	}
+
+	cfg := embed.NewConfig()
+	cfg.Name = "cmapisrv-mock"
+	cfg.Dir = ee.dir
+	cfg.LogLevel = "error"
+	cfg.ListenClientUrls = []url.URL{*ee.clientURL()}
+	cfg.AdvertiseClientUrls = cfg.ListenClientUrls
+	// The peer URL is not used, being the server a single member, hence let
+	// the kernel pick the port, to prevent clashing with other etcd instances.
+	cfg.ListenPeerUrls = []url.URL{{Scheme: "http", Host: "127.0.0.1:0"}}
+	cfg.AdvertisePeerUrls = cfg.ListenPeerUrls
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	ee.log.Info("Starting embedded etcd server", "address", ee.address, "dir", ee.dir)
+	if ee.etcd, err = embed.StartEtcd(cfg); err != nil {
+		ee.cleanup()
+		return fmt.Errorf("starting embedded etcd: %w", err)
+	}
+
+	select {
+	case <-ee.etcd.Server.ReadyNotify():
+		ee.log.Info("Embedded etcd server ready")
+		return nil
+	case err := <-ee.etcd.Err():
+		ee.etcd.Close()
+		ee.cleanup()
+		return fmt.Errorf("running embedded etcd: %w", err)
+	case <-ctx.Done():
+	case <-time.After(embeddedEtcdStartTimeout):
+	}
+
+	ee.etcd.Close()
+	ee.cleanup()
+	return fmt.Errorf("embedded etcd did not become ready within %s", embeddedEtcdStartTimeout)
+}
+
+func (ee *embeddedEtcd) Stop(cell.HookContext) error {
+	ee.log.Info("Stopping embedded etcd server")
+	ee.etcd.Close()
+	ee.cleanup()
+	return nil
+}
+
+// cleanup removes the data directory, if temporary.
+func (ee *embeddedEtcd) cleanup() {
+	if ee.temporary {
+		os.RemoveAll(ee.dir)
+	}
+}
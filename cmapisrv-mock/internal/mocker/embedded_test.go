@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/cilium/hive/cell"
+
+	"github.com/cilium/cilium/pkg/kvstore"
+)
+
+func TestEmbeddedEtcd(t *testing.T) {
+	// Pick a free port for the embedded server to listen on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to pick a free port: %v", err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	var (
+		ctx  = context.Background()
+		log  = slog.New(slog.DiscardHandler)
+		lc   = cell.NewDefaultLifecycle(nil, 0, 0)
+		mcfg = defaultConfig
+	)
+
+	mcfg.EmbeddedEtcd, mcfg.EmbeddedEtcdListenAddress, mcfg.EmbeddedEtcdDataDir = true, address, t.TempDir()
+	cfg := embeddedEtcdConfig(lc, log, kvstore.Config{KVStore: kvstore.DisabledBackendName}, mcfg)
+	if cfg.KVStore != kvstore.EtcdBackendName || cfg.KVStoreOpt[kvstore.EtcdAddrOption] != "http://"+address {
+		t.Fatalf("Unexpected kvstore configuration: %+v", cfg)
+	}
+
+	if err := lc.Start(log, ctx); err != nil {
+		t.Fatalf("Failed to start the embedded etcd server: %v", err)
+	}
+	defer lc.Stop(log, ctx)
+
+	// The embedded server is reachable by regular etcd clients.
+	backend, errCh := kvstore.NewClient(ctx, log, cfg.KVStore, cfg.KVStoreOpt, kvstore.ExtraOptions{})
+	if err := <-errCh; err != nil {
+		t.Fatalf("Failed to connect to the embedded etcd server: %v", err)
+	}
+	defer backend.Close()
+
+	if err := backend.Update(ctx, "foo", []byte("bar"), false); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	if value, err := backend.Get(ctx, "foo"); err != nil || string(value) != "bar" {
+		t.Fatalf("Unexpected value, got %q (err: %v)", value, err)
+	}
+}
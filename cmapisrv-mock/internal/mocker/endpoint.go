@@ -4,6 +4,7 @@
 package mocker
 
 import (
+	"context"
 	"log/slog"
 	"net"
 	"path"
@@ -12,6 +13,7 @@ import (
 	"github.com/cilium/cilium/pkg/identity"
 	"github.com/cilium/cilium/pkg/kvstore"
 	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/lock"
 )
 
 // github.com/cilium/cilium/pkg/ipcache.IPIdentitiesPath
@@ -23,6 +25,7 @@ type endpoints struct {
 	cluster cmtypes.ClusterInfo
 	cache   cache[*identity.IPIdentityPair]
 	rnd     *random
+	mu      lock.Mutex
 
 	podIPGetter    func() net.IP
 	nodeIPGetter   func() net.IP
@@ -30,57 +33,132 @@ type endpoints struct {
 	encKeyGetter   func() uint8
 }
 
+func newEndpointsStore(cp cparams) store.SyncStore {
+	return cp.newSyncStore("ips", cp.layout.endpoints(cp.cluster.Name),
+		store.WSSWithSyncedKeyOverride(cp.layout.prefix(IPIdentitiesPath)))
+}
+
 func newEndpoints(
 	log *slog.Logger, cp cparams,
 	nodes *nodes, identities *identities) *endpoints {
 
-	prefix := kvstore.StateToCachePrefix(IPIdentitiesPath)
-	ss := cp.factory.NewSyncStore(cp.cluster.Name, cp.backend,
-		path.Join(prefix, cp.cluster.Name),
-		store.WSSWithSyncedKeyOverride(prefix))
-
+	ss := newEndpointsStore(cp)
+	rnd := cp.random("ips")
 	eps := &endpoints{
 		cluster:        cp.cluster,
-		cache:          newCache[*identity.IPIdentityPair](),
-		rnd:            cp.rnd,
-		podIPGetter:    cp.rnd.PodIP4,
-		nodeIPGetter:   nodes.RandomHostIP,
-		identityGetter: identities.RandomIdentity,
-		encKeyGetter:   cp.encryption.toKey,
+		cache:          newCompactCache(cp.endpointCodec()),
+		rnd:            rnd,
+		podIPGetter:    rnd.PodIP4,
+		nodeIPGetter:   func() net.IP { return nodes.RandomHostIP(rnd) },
+		identityGetter: func() identity.NumericIdentity { return identities.RandomIdentity(rnd) },
+		encKeyGetter:   cp.encryptionKey.get,
 	}
 
-	if cp.enableIPv6 {
-		eps.podIPGetter = cp.rnd.PodIP
+	switch cp.family {
+	case ipFamilyIPv6:
+		eps.podIPGetter = rnd.PodIP6
+	case ipFamilyDual:
+		eps.podIPGetter = rnd.PodIP
 	}
 
-	eps.syncer = newSyncer(log, "ips", ss, eps.next)
+	eps.syncer = newSyncer(log, "ips", ss, eps.next,
+		newControl(cp.spec.Endpoints, eps.cache.Len),
+		cp.metrics.resource(cp.cluster.Name, "ips"), cp.errors)
+	eps.syncer.mu = &eps.mu
 	return eps
 }
 
-func (eps *endpoints) next(synced bool, target uint) (obj *identity.IPIdentityPair, delete bool) {
-	if synced && eps.rnd.ShouldUpdateUnlikely() && eps.cache.Len() > 0 {
-		endpoint := eps.cache.Get(eps.rnd)
-		endpoint.ID = eps.identityGetter()
-		eps.cache.Upsert(endpoint)
-		return endpoint, false
+// MoveFrom moves all the endpoints hosted on the given node to the target
+// node, or to other random nodes if the target is nil. It must be called after
+// removing the node from the corresponding cache, and before deleting it from
+// the kvstore.
+func (eps *endpoints) MoveFrom(ctx context.Context, hostIP, target net.IP) {
+	eps.update(ctx, hostIP, func(moved *identity.IPIdentityPair) {
+		moved.HostIP, moved.Key = target, eps.encKeyGetter()
+		if target == nil {
+			moved.HostIP = eps.nodeIPGetter()
+		}
+	})
+}
+
+// RekeyFrom switches all the endpoints hosted on the given node to the given
+// IPsec key index.
+func (eps *endpoints) RekeyFrom(ctx context.Context, hostIP net.IP, key uint8) {
+	eps.update(ctx, hostIP, func(rekeyed *identity.IPIdentityPair) {
+		rekeyed.Key = key
+	})
+}
+
+func (eps *endpoints) update(ctx context.Context, hostIP net.IP, mutate func(ep *identity.IPIdentityPair)) {
+	eps.mu.Lock()
+	defer eps.mu.Unlock()
+
+	for _, endpoint := range eps.cache.Select(func(ep *identity.IPIdentityPair) bool { return ep.HostIP.Equal(hostIP) }) {
+		updated := *endpoint
+		mutate(&updated)
+
+		eps.cache.Upsert(&updated)
+		eps.do(ctx, &updated, false)
+	}
+}
+
+// RemoveFrom removes all the endpoints hosted on the given node. It must be
+// called after removing the node from the corresponding cache, and before
+// deleting it from the kvstore.
+func (eps *endpoints) RemoveFrom(ctx context.Context, hostIP net.IP) {
+	eps.remove(ctx, func(ep *identity.IPIdentityPair) bool { return ep.HostIP.Equal(hostIP) })
+}
+
+// RemoveWith removes all the endpoints associated with the given identity. It
+// must be called after removing the identity from the corresponding cache, and
+// before deleting it from the kvstore.
+func (eps *endpoints) RemoveWith(ctx context.Context, id identity.NumericIdentity) {
+	eps.remove(ctx, func(ep *identity.IPIdentityPair) bool { return ep.ID == id })
+}
+
+func (eps *endpoints) remove(ctx context.Context, match func(ep *identity.IPIdentityPair) bool) {
+	eps.mu.Lock()
+	defer eps.mu.Unlock()
+
+	for _, endpoint := range eps.cache.Select(match) {
+		eps.cache.Delete(endpoint.GetKeyName())
+		eps.do(ctx, endpoint, true)
+	}
+}
+
+func (eps *endpoints) next(_ context.Context, synced bool, target uint) (obj *identity.IPIdentityPair, delete bool) {
+	if synced && eps.rnd.ShouldUpdateUnlikely() {
+		if cached, ok := eps.cache.Get(eps.rnd); ok {
+			// Copy the endpoint, as the cached one may be concurrently marshaled.
+			endpoint := *cached
+			endpoint.ID = eps.identityGetter()
+			eps.cache.Upsert(&endpoint)
+			return &endpoint, false
+		}
 	}
 
 	if synced && eps.rnd.ShouldRemove(eps.cache.Len(), target) && eps.cache.Len() > 1 {
 		return eps.cache.Remove(eps.rnd), true
 	}
 
+	hostIP := eps.nodeIPGetter()
+	if hostIP == nil {
+		// There is no node to host the endpoint, yet.
+		return nil, false
+	}
+
 	for {
-		endpoint := eps.new()
+		endpoint := eps.new(hostIP)
 		if eps.cache.Add(endpoint) {
 			return endpoint, false
 		}
 	}
 }
 
-func (eps *endpoints) new() *identity.IPIdentityPair {
+func (eps *endpoints) new(hostIP net.IP) *identity.IPIdentityPair {
 	return &identity.IPIdentityPair{
 		IP:           eps.podIPGetter(),
-		HostIP:       eps.nodeIPGetter(),
+		HostIP:       hostIP,
 		ID:           eps.identityGetter(),
 		Key:          eps.encKeyGetter(),
 		K8sPodName:   eps.rnd.Name(),
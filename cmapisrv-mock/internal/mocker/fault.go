@@ -0,0 +1,442 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/cilium/cilium/pkg/clustermesh/clustercfg"
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+)
+
+type faultType string
+
+const (
+	// faultHeartbeat stops updating the heartbeat key.
+	faultHeartbeat = faultType("heartbeat")
+	// faultCanaries withholds the sync canaries, so that the cluster never
+	// reports to be synchronized.
+	faultCanaries = faultType("canaries")
+	// faultFreeze blocks all writes, until the fault is cleared.
+	faultFreeze = faultType("freeze")
+	// faultVanish abruptly removes all keys at once, as if the kvstore of
+	// the cluster crashed, and blocks all writes until the fault is cleared.
+	faultVanish = faultType("vanish")
+)
+
+var faultTypes = []faultType{faultHeartbeat, faultCanaries, faultFreeze, faultVanish}
+
+func (ft faultType) validate() error {
+	if !slices.Contains(faultTypes, ft) {
+		return fmt.Errorf("unsupported fault %q; must be one of heartbeat|canaries|freeze|vanish", ft)
+	}
+	return nil
+}
+
+// faultSpec configures a fault injected according to a schedule. All instants
+// are relative to the moment the mocker started.
+type faultSpec struct {
+	Type faultType `json:"type"`
+	// After is the delay after which the fault is injected.
+	After duration `json:"after"`
+	// Duration is for how long the fault lasts (indefinitely if zero).
+	Duration duration `json:"duration"`
+}
+
+func (fs faultSpec) validate() error {
+	if err := fs.Type.validate(); err != nil {
+		return err
+	}
+
+	if fs.After < 0 || fs.Duration < 0 {
+		return fmt.Errorf("fault %q: durations must not be negative", fs.Type)
+	}
+
+	return nil
+}
+
+var (
+	errFaultInjected   = errors.New("fault already injected")
+	errFaultCleared    = errors.New("fault not injected")
+	errHeartbeatShared = errors.New("heartbeat shared with other clusters")
+)
+
+// faults tracks the faults currently injected into a given cluster. They
+// persist across reconnections, until explicitly cleared.
+type faults struct {
+	mu      lock.Mutex
+	active  map[faultType]struct{}
+	changed chan struct{}
+
+	// canaries are the sync canaries removed or withheld because of the
+	// faults, to be restored once cleared.
+	canaries map[string]struct{}
+}
+
+func newFaults() *faults {
+	return &faults{
+		active:   make(map[faultType]struct{}),
+		changed:  make(chan struct{}),
+		canaries: make(map[string]struct{}),
+	}
+}
+
+func (f *faults) has(typ faultType) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.active[typ]
+	return ok
+}
+
+// list returns the currently active faults, sorted by type. It is safe to
+// call on a nil receiver.
+func (f *faults) list() []faultType {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Sorted(maps.Keys(f.active))
+}
+
+// set activates or deactivates the given fault, and returns whether it changed.
+func (f *faults) set(typ faultType, active bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.active[typ]; ok == active {
+		return false
+	}
+
+	if active {
+		f.active[typ] = struct{}{}
+	} else {
+		delete(f.active, typ)
+	}
+
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return true
+}
+
+// heartbeat returns whether the heartbeat is stopped, and a channel which is
+// closed when any fault gets modified. It is safe to call on a nil receiver.
+func (f *faults) heartbeat() (stopped bool, changed <-chan struct{}) {
+	if f == nil {
+		return false, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, stopped = f.active[faultHeartbeat]
+	return stopped, f.changed
+}
+
+// wait blocks while writes are frozen, until the context is canceled.
+func (f *faults) wait(ctx context.Context) error {
+	for {
+		f.mu.Lock()
+		_, frozen := f.active[faultFreeze]
+		_, vanished := f.active[faultVanish]
+		changed := f.changed
+		f.mu.Unlock()
+
+		if !frozen && !vanished {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// withhold returns whether the given sync canary shall be withheld, keeping
+// track of it to be restored once the fault is cleared.
+func (f *faults) withhold(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.active[faultCanaries]; !ok {
+		return false
+	}
+
+	f.canaries[key] = struct{}{}
+	return true
+}
+
+// release returns the sync canaries to be restored, if neither the canaries
+// nor the vanish faults are active anymore.
+func (f *faults) release() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, withheld := f.active[faultCanaries]
+	_, vanished := f.active[faultVanish]
+	if withheld || vanished {
+		return nil
+	}
+
+	keys := slices.Sorted(maps.Keys(f.canaries))
+	clear(f.canaries)
+	return keys
+}
+
+func (f *faults) track(keys []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, key := range keys {
+		f.canaries[key] = struct{}{}
+	}
+}
+
+// faultyBackend wraps a kvstore backend, applying the faults injected into
+// the given cluster to the write operations.
+type faultyBackend struct {
+	kvstore.BackendOperations
+
+	faults *faults
+	synced string
+}
+
+func newFaultyBackend(backend kvstore.BackendOperations, faults *faults, cluster string) kvstore.BackendOperations {
+	return &faultyBackend{
+		BackendOperations: backend,
+		faults:            faults,
+		synced:            kvstore.JoinKey(kvstore.SyncedPrefix, cluster) + "/",
+	}
+}
+
+func (fb *faultyBackend) Update(ctx context.Context, key string, value []byte, lease bool) error {
+	if err := fb.faults.wait(ctx); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(key, fb.synced) && fb.faults.withhold(key) {
+		return nil
+	}
+
+	return fb.BackendOperations.Update(ctx, key, value, lease)
+}
+
+func (fb *faultyBackend) UpdateIfDifferent(ctx context.Context, key string, value []byte, lease bool) (bool, error) {
+	if err := fb.faults.wait(ctx); err != nil {
+		return false, err
+	}
+
+	if strings.HasPrefix(key, fb.synced) && fb.faults.withhold(key) {
+		return false, nil
+	}
+
+	return fb.BackendOperations.UpdateIfDifferent(ctx, key, value, lease)
+}
+
+func (fb *faultyBackend) Delete(ctx context.Context, key string) error {
+	if err := fb.faults.wait(ctx); err != nil {
+		return err
+	}
+
+	return fb.BackendOperations.Delete(ctx, key)
+}
+
+func (fb *faultyBackend) DeletePrefix(ctx context.Context, path string) error {
+	if err := fb.faults.wait(ctx); err != nil {
+		return err
+	}
+
+	return fb.BackendOperations.DeletePrefix(ctx, path)
+}
+
+// sharedHeartbeat returns whether the heartbeat key is shared among multiple
+// clusters, hence it cannot be stopped without affecting all of them.
+func (cls *clusters) sharedHeartbeat() bool {
+	return !cls.cfg.dedicatedBackends() && len(cls.specs) > 1
+}
+
+// Inject injects the given fault into the given cluster, whether currently
+// connected or not.
+func (cls *clusters) Inject(ctx context.Context, name string, typ faultType) error {
+	cls.opMu.Lock()
+	defer cls.opMu.Unlock()
+
+	f, ok := cls.faults[name]
+	switch {
+	case !ok:
+		return errClusterNotFound
+	case typ == faultHeartbeat && cls.sharedHeartbeat():
+		return errHeartbeatShared
+	case !f.set(typ, true):
+		return errFaultInjected
+	}
+
+	cls.log.Info("Injecting fault", logfields.ClusterName, name, "fault", typ)
+
+	backend := cls.backendFor(name)
+	switch typ {
+	case faultCanaries:
+		// Remove the canaries already written, to be restored once cleared.
+		if err := cls.removeCanaries(ctx, backend, name, f); err != nil {
+			return fmt.Errorf("removing sync canaries: %w", err)
+		}
+
+	case faultVanish:
+		if err := cls.removeCanaries(ctx, backend, name, f); err != nil {
+			return fmt.Errorf("removing sync canaries: %w", err)
+		}
+
+		cls.mu.RLock()
+		cl := cls.running[name]
+		cls.mu.RUnlock()
+
+		// Clusters not currently connected have no keys left anyways.
+		if cl != nil {
+			if err := cl.cleanup(ctx); err != nil {
+				return fmt.Errorf("removing cluster information: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Clear clears the given fault from the given cluster. Clearing the vanish
+// fault restores all the keys of the cluster, if currently connected.
+func (cls *clusters) Clear(ctx context.Context, name string, typ faultType) error {
+	cls.opMu.Lock()
+	defer cls.opMu.Unlock()
+
+	f, ok := cls.faults[name]
+	switch {
+	case !ok:
+		return errClusterNotFound
+	case !f.has(typ):
+		return errFaultCleared
+	}
+
+	cls.log.Info("Clearing fault", logfields.ClusterName, name, "fault", typ)
+
+	if typ == faultVanish {
+		cls.mu.RLock()
+		cl := cls.running[name]
+		cls.mu.RUnlock()
+
+		// Restore the keys before unblocking the writes, so that the pending
+		// ones are applied on top of the restored state.
+		if cl != nil {
+			if err := cl.restore(ctx); err != nil {
+				return fmt.Errorf("restoring cluster information: %w", err)
+			}
+		}
+	}
+
+	f.set(typ, false)
+
+	backend := cls.backendFor(name)
+	for _, key := range f.release() {
+		if err := backend.Update(ctx, key, []byte(time.Now().Format(time.RFC3339)), true); err != nil {
+			return fmt.Errorf("restoring sync canary: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// removeCanaries removes the sync canaries of the given cluster, keeping track
+// of them to be restored once the faults get cleared.
+func (cls *clusters) removeCanaries(ctx context.Context, backend kvstore.BackendOperations, name string, f *faults) error {
+	// Make sure to append the trailing slash, to prevent matching
+	// the keys of clusters whose name starts with the same prefix.
+	prefix := kvstore.JoinKey(kvstore.SyncedPrefix, name) + "/"
+	kvs, err := backend.ListPrefix(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	f.track(slices.Collect(maps.Keys(kvs)))
+	return backend.DeletePrefix(ctx, prefix)
+}
+
+// restore writes again all the objects the mocker believes to have written,
+// together with the ClusterConfig, following the vanishing of all keys. The
+// objects of clusters replaying a recording are not tracked, and cannot be
+// restored.
+func (cl *cluster) restore(ctx context.Context) error {
+	if !cl.spec.ClusterConfig.Omit {
+		if err := clustercfg.Set(ctx, cl.cinfo.Name, cl.clusterConfig(), cl.bypass); err != nil {
+			return fmt.Errorf("writing ClusterConfig: %w", err)
+		}
+	}
+
+	if cl.replay != nil {
+		cl.log.Warn("Cannot restore the objects of a cluster replaying a recording")
+		return nil
+	}
+
+	for _, res := range auditResources {
+		expected, err := res.expected(cl, res.prefix(cl))
+		if err != nil {
+			return err
+		}
+
+		for key, value := range expected {
+			if err := cl.bypass.Update(ctx, key, value, true); err != nil {
+				return fmt.Errorf("writing %s: %w", res.typ, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// scheduleFault injects and clears the given fault according to its schedule,
+// until the context is canceled.
+func (cls *clusters) scheduleFault(ctx context.Context, name string, fs faultSpec) {
+	var (
+		log   = cls.log.With(logfields.ClusterName, name, "fault", fs.Type)
+		start = time.Now()
+	)
+
+	wait := func(after duration) bool {
+		timer := time.NewTimer(time.Until(start.Add(time.Duration(after))))
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		}
+	}
+
+	if !wait(fs.After) {
+		return
+	}
+
+	if err := cls.Inject(ctx, name, fs.Type); err != nil && ctx.Err() == nil {
+		log.Warn("Failed to inject fault according to schedule", logfields.Error, err)
+	}
+
+	if fs.Duration == 0 || !wait(fs.After+fs.Duration) {
+		return
+	}
+
+	if err := cls.Clear(ctx, name, fs.Type); err != nil && ctx.Err() == nil {
+		log.Warn("Failed to clear fault according to schedule", logfields.Error, err)
+	}
+}
@@ -4,6 +4,7 @@
 package mocker
 
 import (
+	"context"
 	"log/slog"
 	"path"
 	"strconv"
@@ -12,6 +13,7 @@ import (
 	"github.com/cilium/cilium/pkg/identity"
 	"github.com/cilium/cilium/pkg/kvstore"
 	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/labels"
 )
 
 // github.com/cilium/cilium/pkg/identity/cache.IdentitiesPath
@@ -23,31 +25,45 @@ type identities struct {
 	cluster cmtypes.ClusterInfo
 	cache   cache[*store.KVPair]
 	rnd     *random
+	shape   identityShape
 }
 
-func newIdentities(log *slog.Logger, cp cparams) *identities {
-	prefix := kvstore.StateToCachePrefix(IdentitiesPath)
-	ss := cp.factory.NewSyncStore(cp.cluster.Name, cp.backend,
-		path.Join(prefix, cp.cluster.Name, "id"),
-		store.WSSWithSyncedKeyOverride(prefix))
+func newIdentitiesStore(cp cparams) store.SyncStore {
+	return cp.newSyncStore("identities", cp.layout.identities(cp.cluster.Name),
+		store.WSSWithSyncedKeyOverride(cp.layout.prefix(IdentitiesPath)))
+}
 
+func newIdentities(log *slog.Logger, cp cparams) *identities {
+	ss := newIdentitiesStore(cp)
 	ids := &identities{
 		cluster: cp.cluster,
 		cache:   newCache[*store.KVPair](),
-		rnd:     cp.rnd,
+		rnd:     cp.random("identities"),
+		shape:   cp.spec.IdentityShape,
 	}
 
-	ids.syncer = newSyncer(log, "identities", ss, ids.next)
+	ids.syncer = newSyncer(log, "identities", ss, ids.next,
+		newControl(cp.spec.Identities, ids.cache.Len),
+		cp.metrics.resource(cp.cluster.Name, "identities"), cp.errors)
 	return ids
 }
 
-func (ids *identities) RandomIdentity() identity.NumericIdentity {
-	id := ids.cache.Get(ids.rnd)
-	parsed, _ := strconv.ParseUint(id.Key, 10, 32)
+// RandomIdentity returns a random identity, or the invalid one if there is none.
+func (ids *identities) RandomIdentity(rnd *random) identity.NumericIdentity {
+	kv, ok := ids.cache.Get(rnd)
+	if !ok {
+		return identity.InvalidIdentity
+	}
+
+	return ids.parse(kv)
+}
+
+func (ids *identities) parse(kv *store.KVPair) identity.NumericIdentity {
+	parsed, _ := strconv.ParseUint(kv.Key, 10, 32)
 	return identity.NumericIdentity(parsed)
 }
 
-func (ids *identities) next(synced bool, target uint) (obj *store.KVPair, delete bool) {
+func (ids *identities) next(_ context.Context, synced bool, target uint) (obj *store.KVPair, delete bool) {
 	if synced && ids.rnd.ShouldRemove(ids.cache.Len(), target) && ids.cache.Len() > 1 {
 		return ids.cache.Remove(ids.rnd), true
 	}
@@ -62,13 +78,18 @@ func (ids *identities) next(synced bool, target uint) (obj *store.KVPair, delete
 
 func (ids *identities) new(id identity.NumericIdentity) *store.KVPair {
 	if id == identity.InvalidIdentity {
-		id = ids.rnd.Identity(ids.cluster.ID)
+		id = ids.rnd.Identity(ids.cluster)
 	}
 
-	var lbls []byte
-	for _, lb := range ids.rnd.IdentityLabels(ids.cluster.Name).Sort() {
-		lbls = append(lbls, lb.FormatForKVStore()...)
+	return newIdentityKV(id, ids.rnd.IdentityLabels(ids.cluster.Name, ids.shape))
+}
+
+// newIdentityKV returns the key-value pair representing the given identity.
+func newIdentityKV(id identity.NumericIdentity, lbls labels.LabelArray) *store.KVPair {
+	var value []byte
+	for _, lb := range lbls.Sort() {
+		value = append(value, lb.FormatForKVStore()...)
 	}
 
-	return store.NewKVPair(strconv.FormatUint(uint64(id), 10), string(lbls))
+	return store.NewKVPair(strconv.FormatUint(uint64(id), 10), string(value))
 }
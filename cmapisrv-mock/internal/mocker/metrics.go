@@ -0,0 +1,152 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/metrics"
+	"github.com/cilium/cilium/pkg/metrics/metric"
+)
+
+const (
+	labelCluster   = "cluster"
+	labelResource  = "resource"
+	labelOperation = "operation"
+
+	operationUpsert = "upsert"
+	operationDelete = "delete"
+)
+
+type mockerMetrics struct {
+	Operations         metric.DeletableVec[metric.Counter]
+	Objects            metric.DeletableVec[metric.Gauge]
+	ConfiguredQPS      metric.DeletableVec[metric.Gauge]
+	OperationDuration  metric.Vec[metric.Observer]
+	RateLimiterWaiting metric.Vec[metric.Observer]
+	Failures           metric.Vec[metric.Counter]
+}
+
+func newMetrics() *mockerMetrics {
+	return &mockerMetrics{
+		Operations: metric.NewCounterVec(metric.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "operations_total",
+			Help:      "Number of upsert and delete operations successfully written to the kvstore by the mocker",
+		}, []string{labelCluster, labelResource, labelOperation}),
+		Objects: metric.NewGaugeVec(metric.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Name:      "objects",
+			Help:      "Number of objects currently mocked",
+		}, []string{labelCluster, labelResource}),
+		ConfiguredQPS: metric.NewGaugeVec(metric.GaugeOpts{
+			Namespace: metrics.Namespace,
+			Name:      "configured_qps",
+			Help:      "Configured operations per second, modulated according to the churn profile",
+		}, []string{labelCluster, labelResource}),
+		OperationDuration: metric.NewHistogramVec(metric.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of the upsert and delete operations performed against the kvstore by the sync stores",
+			Buckets:   prometheus.ExponentialBuckets(1e-6, 4, 12),
+		}, []string{labelResource, labelOperation}),
+		RateLimiterWaiting: metric.NewHistogramVec(metric.HistogramOpts{
+			Namespace: metrics.Namespace,
+			Name:      "rate_limiter_wait_duration_seconds",
+			Help:      "Time waited for the rate limiter before performing each operation",
+			Buckets:   prometheus.ExponentialBuckets(1e-3, 4, 10),
+		}, []string{labelResource}),
+		Failures: metric.NewCounterVec(metric.CounterOpts{
+			Namespace: metrics.Namespace,
+			Name:      "kvstore_failures_total",
+			Help:      "Number of failed kvstore operations, including the ones subsequently retried",
+		}, []string{labelOperation}),
+	}
+}
+
+// resourceMetrics are the metrics associated with a given cluster and resource type.
+type resourceMetrics struct {
+	upserts, deletes               metric.Counter
+	objects, qps                   metric.Gauge
+	upsertDuration, deleteDuration prometheus.Observer
+	waiting                        prometheus.Observer
+}
+
+func (m *mockerMetrics) resource(cluster, typ string) resourceMetrics {
+	return resourceMetrics{
+		upserts:        m.Operations.WithLabelValues(cluster, typ, operationUpsert),
+		deletes:        m.Operations.WithLabelValues(cluster, typ, operationDelete),
+		objects:        m.Objects.WithLabelValues(cluster, typ),
+		qps:            m.ConfiguredQPS.WithLabelValues(cluster, typ),
+		upsertDuration: m.OperationDuration.WithLabelValues(typ, operationUpsert),
+		deleteDuration: m.OperationDuration.WithLabelValues(typ, operationDelete),
+		waiting:        m.RateLimiterWaiting.WithLabelValues(typ),
+	}
+}
+
+// deleteCluster removes the metrics associated with the given cluster,
+// following its disconnection.
+func (m *mockerMetrics) deleteCluster(cluster string) {
+	labels := prometheus.Labels{labelCluster: cluster}
+	m.Operations.DeletePartialMatch(labels)
+	m.Objects.DeletePartialMatch(labels)
+	m.ConfiguredQPS.DeletePartialMatch(labels)
+}
+
+func (rm resourceMetrics) observe(delete bool, start time.Time) {
+	if delete {
+		rm.deletes.Inc()
+		rm.deleteDuration.Observe(time.Since(start).Seconds())
+		return
+	}
+
+	rm.upserts.Inc()
+	rm.upsertDuration.Observe(time.Since(start).Seconds())
+}
+
+// meteredBackend wraps a kvstore backend, observing the write operations
+// performed by the SyncStore of a given cluster and resource type, once
+// completed. Differently from the requests to the SyncStore, which are
+// asynchronous and possibly coalesced, this reflects the actual kvstore writes.
+type meteredBackend struct {
+	kvstore.BackendOperations
+
+	prefix  string
+	metrics resourceMetrics
+}
+
+func newMeteredBackend(backend kvstore.BackendOperations, prefix string, metrics resourceMetrics) kvstore.BackendOperations {
+	return &meteredBackend{
+		BackendOperations: backend,
+		prefix:            prefix + "/",
+		metrics:           metrics,
+	}
+}
+
+func (mb *meteredBackend) Update(ctx context.Context, key string, value []byte, lease bool) error {
+	start := time.Now()
+	err := mb.BackendOperations.Update(ctx, key, value, lease)
+	mb.observe(key, false, start, err)
+	return err
+}
+
+func (mb *meteredBackend) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := mb.BackendOperations.Delete(ctx, key)
+	mb.observe(key, true, start, err)
+	return err
+}
+
+func (mb *meteredBackend) observe(key string, delete bool, start time.Time, err error) {
+	// Skip the failed operations, which are retried by the SyncStore, and
+	// the sync canaries, which do not correspond to any mocked object.
+	if err == nil && strings.HasPrefix(key, mb.prefix) {
+		mb.metrics.observe(delete, start)
+	}
+}
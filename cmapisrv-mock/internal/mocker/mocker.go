@@ -19,13 +19,16 @@ import (
 )
 
 type mocker struct {
-	cfg config
+	cfg   config
+	specs []clusterSpec
 
 	log *slog.Logger
 
 	backend kvstore.Client
 	factory store.Factory
 	rnd     *random
+	cls     *clusters
+	errs    *errorTracker
 
 	syncState syncstate.SyncState
 }
@@ -38,21 +41,30 @@ func newMocker(in struct {
 	JobGroup  job.Group
 
 	Config    config
+	Specs     []clusterSpec
+	Recording *recording
+	Dataset   *dataset
+	Metrics   *mockerMetrics
+	Errors    *errorTracker
 	Backend   kvstore.Client
+	KVConfig  kvstore.Config
 	Factory   store.Factory
 	Random    *random
 	SyncState syncstate.SyncState
 }) *mocker {
 	mk := &mocker{
 		cfg:       in.Config,
+		specs:     in.Specs,
 		log:       in.Logger,
 		backend:   in.Backend,
 		factory:   in.Factory,
 		rnd:       in.Random,
 		syncState: in.SyncState,
+		errs:      in.Errors,
 	}
 
-	in.JobGroup.Add(job.OneShot("mocker", mk.Run))
+	mk.cls = newClusters(mk.log, mk.cfg, mk.specs, mk.factory, mk.backend, in.KVConfig, mk.rnd, in.Recording, in.Dataset, in.Metrics, in.Errors)
+	in.JobGroup.Add(job.OneShot("mocker", mk.Run, job.WithShutdown()))
 	return mk
 }
 
@@ -62,23 +74,30 @@ func (mk *mocker) Run(ctx context.Context, _ cell.Health) error {
 	// local one can access the data cached via KVStoreMesh. However, in this
 	// scale test, the mocker leverages the KVStoreMesh API to mock multiple
 	// clusters at once. Hence, let's tune the user permissions so that the
-	// real KVStoreMesh container can then retrieve the mocked data.
-	mk.backend.UserEnforcePresence(ctx, "remote", []string{"local", "remote"})
+	// real KVStoreMesh container can then retrieve the mocked data. In direct
+	// mode, the same permissions let agents access the non-cached prefixes.
+	// The embedded etcd server has authentication disabled, instead.
+	if !mk.cfg.EmbeddedEtcd {
+		mk.backend.UserEnforcePresence(ctx, "remote", []string{"local", "remote"})
+	}
 
-	cls := newClusters(mk.log, mk.cfg, mk.factory, mk.backend, mk.rnd)
-	cls.Run(ctx, mk.syncState)
-	return nil
+	return mk.cls.Run(ctx, mk.syncState)
 }
 
 func (mk *mocker) HealthEndpoints() []health.EndpointFunc {
-	return []health.EndpointFunc{
+	return append([]health.EndpointFunc{
 		{
 			Path: "/readyz",
 			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {
 				statusCode := http.StatusInternalServerError
 				reply := "NotReady"
 
-				if mk.syncState.Complete() {
+				switch {
+				case !mk.syncState.Complete():
+				case !mk.errs.healthy():
+					// Surface that kvstore operations are currently failing.
+					reply = "NotReady: failing kvstore operations"
+				default:
 					statusCode = http.StatusOK
 					reply = "Ready"
 				}
@@ -89,5 +108,5 @@ func (mk *mocker) HealthEndpoints() []health.EndpointFunc {
 				}
 			},
 		},
-	}
+	}, mk.controlEndpoints()...)
 }
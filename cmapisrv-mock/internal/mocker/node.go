@@ -4,13 +4,14 @@
 package mocker
 
 import (
+	"context"
 	"log/slog"
 	"net"
-	"os"
 
 	"github.com/cilium/cilium/pkg/cidr"
 	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
-	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/lock"
 	"github.com/cilium/cilium/pkg/logging/logfields"
 	"github.com/cilium/cilium/pkg/node/addressing"
 	nodeStore "github.com/cilium/cilium/pkg/node/store"
@@ -23,34 +24,58 @@ type nodes struct {
 	cluster     cmtypes.ClusterInfo
 	cache       cache[*nodeTypes.Node]
 	rnd         *random
-	enableIPv6  bool
+	family      ipFamily
 	encryption  encryptionMode
+	key         *encryptionKey
 	annotations map[string]string
+	mu          lock.Mutex
 }
 
-func newNodes(log *slog.Logger, cp cparams) *nodes {
-	prefix := kvstore.StateToCachePrefix(nodeStore.NodeStorePrefix)
-	ss := cp.factory.NewSyncStore(cp.cluster.Name, cp.backend, prefix)
+func newNodesStore(cp cparams) store.SyncStore {
+	prefix := cp.layout.prefix(nodeStore.NodeStorePrefix)
+	return cp.newSyncStore("nodes", prefix)
+}
 
+func newNodes(log *slog.Logger, cp cparams) *nodes {
+	ss := newNodesStore(cp)
 	ns := &nodes{
 		cluster:     cp.cluster,
-		cache:       newCache[*nodeTypes.Node](),
-		rnd:         cp.rnd,
-		enableIPv6:  cp.enableIPv6,
+		cache:       newCompactCache(cp.nodeCodec()),
+		rnd:         cp.random("nodes"),
+		family:      cp.family,
 		encryption:  cp.encryption,
+		key:         cp.encryptionKey,
 		annotations: cp.nodeAnnotations,
 	}
 
-	ns.syncer = newSyncer(log, "nodes", ss, ns.next)
+	ns.syncer = newSyncer(log, "nodes", ss, ns.next,
+		newControl(cp.spec.Nodes, ns.cache.Len),
+		cp.metrics.resource(cp.cluster.Name, "nodes"), cp.errors)
+	ns.syncer.mu = &ns.mu
 	return ns
 }
 
-func (ns *nodes) RandomHostIP() net.IP {
-	no := ns.cache.Get(ns.rnd)
-	return no.GetNodeInternalIPv4()
+// RandomHostIP returns the host IP of a random node, or nil if there is none.
+func (ns *nodes) RandomHostIP(rnd *random) net.IP {
+	no, ok := ns.cache.Get(rnd)
+	if !ok {
+		return nil
+	}
+
+	return hostIP(no)
+}
+
+// hostIP returns the IP address identifying the given node as the host of
+// the endpoints, which is the IPv6 one in case of IPv6-only nodes.
+func hostIP(no *nodeTypes.Node) net.IP {
+	if ip := no.GetNodeInternalIPv4(); ip != nil {
+		return ip
+	}
+
+	return no.GetNodeInternalIPv6()
 }
 
-func (ns *nodes) next(synced bool, target uint) (obj *nodeTypes.Node, delete bool) {
+func (ns *nodes) next(_ context.Context, synced bool, target uint) (obj *nodeTypes.Node, delete bool) {
 	if synced && ns.rnd.ShouldRemove(ns.cache.Len(), target) && ns.cache.Len() > 1 {
 		return ns.cache.Remove(ns.rnd), true
 	}
@@ -63,30 +88,36 @@ func (ns *nodes) next(synced bool, target uint) (obj *nodeTypes.Node, delete boo
 	}
 }
 
+// nodeLabels returns the labels of the mocked node with the given name.
+func nodeLabels(name string) map[string]string {
+	return map[string]string{
+		"kubernetes.io/hostname": name,
+		"kubernetes.io/arch":     "amd64",
+		"kubernetes.io/os":       "linux",
+	}
+}
+
 func (ns *nodes) new() *nodeTypes.Node {
 	name := ns.rnd.Name()
 
 	no := &nodeTypes.Node{
-		Name:      name,
-		Cluster:   ns.cluster.Name,
-		ClusterID: ns.cluster.ID,
-		Labels: map[string]string{
-			"kubernetes.io/hostname": name,
-			"kubernetes.io/arch":     "amd64",
-			"kubernetes.io/os":       "linux",
-		},
-		Annotations: ns.annotations,
-		IPAddresses: []nodeTypes.Address{
-			{Type: addressing.NodeInternalIP, IP: ns.rnd.NodeIP4()},
-			{Type: addressing.NodeCiliumInternalIP, IP: ns.rnd.PodIP4()},
-		},
-		IPv4AllocCIDR: &cidr.CIDR{IPNet: ns.rnd.CIDR4()},
-		IPv4HealthIP:  ns.rnd.PodIP4(),
-		IPv4IngressIP: ns.rnd.PodIP4(),
-		EncryptionKey: ns.encryption.toKey(),
+		Name:          name,
+		Cluster:       ns.cluster.Name,
+		ClusterID:     ns.cluster.ID,
+		Labels:        nodeLabels(name),
+		Annotations:   ns.annotations,
+		EncryptionKey: ns.key.get(),
+	}
+
+	if ns.family.ipv4() {
+		no.IPAddresses = append(no.IPAddresses, nodeTypes.Address{Type: addressing.NodeInternalIP, IP: ns.rnd.NodeIP4()})
+		no.IPAddresses = append(no.IPAddresses, nodeTypes.Address{Type: addressing.NodeCiliumInternalIP, IP: ns.rnd.PodIP4()})
+		no.IPv4AllocCIDR = &cidr.CIDR{IPNet: ns.rnd.CIDR4()}
+		no.IPv4HealthIP = ns.rnd.PodIP4()
+		no.IPv4IngressIP = ns.rnd.PodIP4()
 	}
 
-	if ns.enableIPv6 {
+	if ns.family.ipv6() {
 		no.IPAddresses = append(no.IPAddresses, nodeTypes.Address{Type: addressing.NodeInternalIP, IP: ns.rnd.NodeIP6()})
 		no.IPAddresses = append(no.IPAddresses, nodeTypes.Address{Type: addressing.NodeCiliumInternalIP, IP: ns.rnd.PodIP6()})
 		no.IPv6AllocCIDR = &cidr.CIDR{IPNet: ns.rnd.CIDR6()}
@@ -95,10 +126,11 @@ func (ns *nodes) new() *nodeTypes.Node {
 	}
 
 	if ns.encryption == encryptionModeWireGuard {
+		// The node is still mocked without the key, in the unlikely case
+		// that its generation fails.
 		key, err := ns.rnd.WireGuardPublicKey()
 		if err != nil {
 			ns.log.Error("Failed to generate WireGuard key", logfields.Error, err)
-			os.Exit(-1)
 		}
 
 		no.WireguardPubKey = key
@@ -0,0 +1,263 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"maps"
+	"slices"
+
+	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
+	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/labels"
+	"github.com/cilium/cilium/pkg/lock"
+)
+
+// workload is a set of pods sharing the same labels, hence the same identity,
+// which are selected by the same services.
+type workload struct {
+	namespace string
+	app       string
+	labels    labels.LabelArray
+
+	// identity is the identity allocated for the workload, while any of
+	// its pods is running, and pods are the addresses of the running ones.
+	identity identity.NumericIdentity
+	pods     map[string]struct{}
+}
+
+// pods drives the correlated churn of identities, endpoints and services, in
+// terms of pods being started and deleted. Starting a pod allocates a new
+// identity if none of the other pods of the same workload is running, adds
+// the corresponding endpoint, and then the backend to all the services
+// selecting the workload. Deleting a pod performs the same operations in
+// reverse order, deleting the identity once no longer used.
+//
+// The endpoints target and QPS correspond to the number of running pods, and
+// to the pods started and deleted per second. The identities target is the
+// number of workloads instead, while their QPS does not apply, as identities
+// are not churned independently.
+type pods struct {
+	cluster cmtypes.ClusterInfo
+	rnd     *random
+	shape   identityShape
+
+	identities *identities
+	endpoints  *endpoints
+	services   *services
+
+	// mu protects the workloads, which are generated on demand up to the
+	// number configured through the identities target.
+	mu         lock.Mutex
+	workloads  []*workload
+	byIdentity map[identity.NumericIdentity]*workload
+}
+
+// newPods returns the pods of the given cluster, taking over the generation of
+// the identities, endpoints and service backends from the respective syncers.
+func newPods(cp cparams, identities *identities, endpoints *endpoints, services *services) *pods {
+	p := &pods{
+		cluster: cp.cluster,
+		// The workloads do not allocate any address, hence the stream is
+		// not interleaved with the other ones.
+		rnd:        cp.rnd.Stream(cp.streamName("workloads")).WithPools(cp.namespaces, cp.serviceAccounts),
+		shape:      cp.spec.IdentityShape,
+		identities: identities,
+		endpoints:  endpoints,
+		services:   services,
+		byIdentity: make(map[identity.NumericIdentity]*workload),
+	}
+
+	// Identities are allocated on demand when starting the pods, hence the
+	// identities syncer does not generate any object by itself, nor it runs
+	// the churn, but it marks the initial synchronization as completed only
+	// after the endpoints. Its target is the number of workloads instead.
+	identities.syncer.next = func(context.Context, bool, uint) (*store.KVPair, bool) { return nil, false }
+	identities.syncer.waitFor = endpoints.WaitForSync
+	identities.ctrl.passive = true
+
+	endpoints.syncer.next = p.next
+	endpoints.syncer.onDelete = p.stopping
+	endpoints.syncer.onDeleted = p.stopped
+
+	services.withBackendsFrom(endpoints)
+	services.pods = p
+	return p
+}
+
+// next starts a new pod, or deletes a random one. The operations associated
+// with the start of a pod are directly performed in the appropriate order,
+// while the ones associated with its deletion are performed by the hooks, as
+// pods may be also deleted together with the hosting node.
+func (p *pods) next(ctx context.Context, synced bool, target uint) (obj *identity.IPIdentityPair, delete bool) {
+	eps := p.endpoints
+	if synced && eps.rnd.ShouldRemove(eps.cache.Len(), target) && eps.cache.Len() > 1 {
+		return eps.cache.Remove(eps.rnd), true
+	}
+
+	hostIP := eps.nodeIPGetter()
+	if hostIP == nil {
+		// There is no node to host the pod, yet.
+		return nil, false
+	}
+
+	p.mu.Lock()
+	w := p.pick(eps.rnd)
+
+	var allocated *store.KVPair
+	if w.identity == identity.InvalidIdentity {
+		for {
+			allocated = newIdentityKV(p.identities.rnd.Identity(p.cluster), w.labels)
+			if p.identities.cache.Add(allocated) {
+				break
+			}
+		}
+
+		w.identity = p.identities.parse(allocated)
+		p.byIdentity[w.identity] = w
+	}
+
+	var endpoint *identity.IPIdentityPair
+	for {
+		endpoint = &identity.IPIdentityPair{
+			IP:           eps.podIPGetter(),
+			HostIP:       hostIP,
+			ID:           w.identity,
+			Key:          eps.encKeyGetter(),
+			K8sPodName:   w.app + "-" + eps.rnd.Name(),
+			K8sNamespace: w.namespace,
+		}
+
+		if eps.cache.Add(endpoint) {
+			break
+		}
+	}
+
+	w.pods[endpoint.GetKeyName()] = struct{}{}
+	p.mu.Unlock()
+
+	if allocated != nil {
+		p.identities.do(ctx, allocated, false)
+	}
+
+	eps.do(ctx, endpoint, false)
+	p.services.AddBackend(ctx, w, endpoint.GetKeyName())
+	return nil, false
+}
+
+// stopping removes the pod associated with the given endpoint from the
+// corresponding workload, so that it is no longer selected by new services,
+// and from all the services already selecting it.
+func (p *pods) stopping(ctx context.Context, endpoint *identity.IPIdentityPair) {
+	p.mu.Lock()
+	if w, ok := p.byIdentity[endpoint.ID]; ok {
+		delete(w.pods, endpoint.GetKeyName())
+	}
+	p.mu.Unlock()
+
+	p.services.RemoveBackend(ctx, endpoint.GetKeyName())
+}
+
+// stopped deletes the identity of the pod associated with the given endpoint,
+// if no longer used by any other pod.
+func (p *pods) stopped(ctx context.Context, endpoint *identity.IPIdentityPair) {
+	p.mu.Lock()
+	w, ok := p.byIdentity[endpoint.ID]
+	if !ok || len(w.pods) > 0 {
+		p.mu.Unlock()
+		return
+	}
+
+	delete(p.byIdentity, w.identity)
+	kv, ok := p.identities.cache.Lookup(w.identity.StringID())
+	p.identities.cache.Delete(w.identity.StringID())
+	w.identity = identity.InvalidIdentity
+	p.mu.Unlock()
+
+	if ok {
+		p.identities.do(ctx, kv, true)
+	}
+}
+
+// Sample returns a random workload, together with the addresses of the
+// associated running pods.
+func (p *pods) Sample(rnd *random) (w *workload, running []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	w = p.pick(rnd)
+	return w, slices.Collect(maps.Keys(w.pods))
+}
+
+// pick returns a random workload, among the ones configured through the
+// identities target. It must be called while holding the mutex.
+func (p *pods) pick(rnd *random) *workload {
+	n := max(p.identities.ctrl.state().target, 1)
+
+	// Workloads are generated in order, and from a dedicated stream, so that
+	// they do not depend on the interleaving of the operations.
+	for uint(len(p.workloads)) < n {
+		lbls := p.rnd.IdentityLabels(p.cluster.Name, p.shape)
+		w := &workload{
+			namespace: lbls.Get("k8s:io.kubernetes.pod.namespace"),
+			app:       p.rnd.Name(),
+			pods:      make(map[string]struct{}),
+		}
+
+		w.labels = append(lbls, labels.NewLabel("app", w.app, labels.LabelSourceK8s)).Sort()
+		p.workloads = append(p.workloads, w)
+	}
+
+	return p.workloads[rnd.Index(int(n))]
+}
+
+// selects returns whether the given service selects the pods of the given
+// workload.
+func selects(cs *serviceStore.ClusterService, w *workload) bool {
+	return cs.Namespace == w.namespace && cs.Selector["app"] == w.app
+}
+
+// newForPods returns a new service, selecting the pods of a random workload.
+func (svc *services) newForPods() *serviceStore.ClusterService {
+	w, running := svc.pods.Sample(svc.rnd)
+	shared, includeExternal := svc.shape.Mix.sample(svc.rnd)
+
+	backends := make(map[string]serviceStore.PortConfiguration, len(running))
+	for _, ip := range running {
+		backends[ip] = svc.shape.backendPorts()
+	}
+
+	return &serviceStore.ClusterService{
+		Cluster:         svc.cluster.Name,
+		ClusterID:       svc.cluster.ID,
+		Namespace:       w.namespace,
+		Labels:          map[string]string{"app": w.app},
+		Selector:        map[string]string{"app": w.app},
+		Name:            svc.rnd.Name(),
+		Frontends:       svc.frontends(),
+		Backends:        backends,
+		Shared:          shared,
+		IncludeExternal: includeExternal,
+	}
+}
+
+// AddBackend adds the given backend to all the services selecting the given
+// workload. It must be called after upserting the corresponding endpoint.
+func (svc *services) AddBackend(ctx context.Context, w *workload, ip string) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	for _, service := range svc.cache.Select(func(cs *serviceStore.ClusterService) bool {
+		return selects(cs, w) && cs.Backends[ip] == nil
+	}) {
+		updated := *service
+		updated.Backends = maps.Clone(service.Backends)
+		updated.Backends[ip] = svc.shape.backendPorts()
+
+		svc.cache.Upsert(&updated)
+		svc.do(ctx, &updated, false)
+	}
+}
@@ -0,0 +1,163 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+// profileResolution is the maximum interval after which the current rate is
+// recomputed, in case a time-varying churn profile is configured.
+const profileResolution = time.Second
+
+type profileType string
+
+const (
+	profileConstant = profileType("constant")
+	profileRamp     = profileType("ramp")
+	profileBurst    = profileType("burst")
+	profileStep     = profileType("step")
+	profileSine     = profileType("sine")
+)
+
+// profile modulates the configured QPS over time. The rate at a given instant
+// corresponds to the configured QPS multiplied by the factor returned by the
+// profile, given the time elapsed since the beginning of the churn phase.
+type profile struct {
+	// Type is the type of the profile (constant|ramp|burst|step|sine).
+	Type profileType `json:"type"`
+
+	// From and To are the initial and final factors of a ramp profile,
+	// which linearly transitions between the two over Duration.
+	From float64 `json:"from"`
+	To   float64 `json:"to"`
+
+	// Period is the period of burst and sine profiles.
+	Period duration `json:"period"`
+	// Duration is the duration of a ramp, or of each burst.
+	Duration duration `json:"duration"`
+	// Factor is the factor applied during each burst (it is 1 otherwise).
+	Factor float64 `json:"factor"`
+	// Amplitude is the amplitude of the sine wave, centered around 1.
+	Amplitude float64 `json:"amplitude"`
+
+	// Steps are the factors applied starting from the given instants by
+	// a step profile (it is 1 before the first step).
+	Steps []step `json:"steps"`
+}
+
+type step struct {
+	After  duration `json:"after"`
+	Factor float64  `json:"factor"`
+}
+
+func (p profile) validate() error {
+	switch p.Type {
+	case "", profileConstant:
+	case profileRamp:
+		if p.Duration <= 0 {
+			return errors.New("ramp profile: duration must be positive")
+		}
+		if p.From < 0 || p.To < 0 {
+			return errors.New("ramp profile: factors must not be negative")
+		}
+	case profileBurst:
+		if p.Period <= 0 || p.Duration <= 0 || p.Duration > p.Period {
+			return errors.New("burst profile: period and duration must be positive, and duration must not exceed the period")
+		}
+		if p.Factor < 0 {
+			return errors.New("burst profile: factor must not be negative")
+		}
+	case profileStep:
+		if len(p.Steps) == 0 {
+			return errors.New("step profile: at least one step must be specified")
+		}
+		if !slices.IsSortedFunc(p.Steps, func(a, b step) int { return cmp.Compare(a.After, b.After) }) {
+			return errors.New("step profile: steps must be sorted by time")
+		}
+		for _, st := range p.Steps {
+			if st.Factor < 0 {
+				return errors.New("step profile: factors must not be negative")
+			}
+		}
+	case profileSine:
+		if p.Period <= 0 {
+			return errors.New("sine profile: period must be positive")
+		}
+		if p.Amplitude < 0 || p.Amplitude > 1 {
+			return errors.New("sine profile: amplitude must be in range 0..1")
+		}
+	default:
+		return fmt.Errorf("unsupported profile type %q; must be one of constant|ramp|burst|step|sine", p.Type)
+	}
+
+	return nil
+}
+
+// dynamic returns whether the profile varies over time.
+func (p profile) dynamic() bool {
+	return p.Type != "" && p.Type != profileConstant
+}
+
+// factor returns the factor to be applied to the configured QPS, given the
+// time elapsed since the beginning of the churn phase.
+func (p profile) factor(elapsed time.Duration) float64 {
+	switch p.Type {
+	case profileRamp:
+		if elapsed >= time.Duration(p.Duration) {
+			return p.To
+		}
+		return p.From + (p.To-p.From)*float64(elapsed)/float64(p.Duration)
+
+	case profileBurst:
+		if elapsed%time.Duration(p.Period) < time.Duration(p.Duration) {
+			return p.Factor
+		}
+		return 1
+
+	case profileStep:
+		factor := 1.0
+		for _, st := range p.Steps {
+			if elapsed < time.Duration(st.After) {
+				break
+			}
+			factor = st.Factor
+		}
+		return factor
+
+	case profileSine:
+		return 1 + p.Amplitude*math.Sin(2*math.Pi*float64(elapsed)/float64(p.Period))
+
+	default:
+		return 1
+	}
+}
+
+// duration wraps time.Duration to support unmarshaling from strings such as "5m".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("invalid duration %s: %w", data, err)
+	}
+
+	parsed, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
@@ -4,13 +4,22 @@
 package mocker
 
 import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"math/bits"
 	"math/rand"
 	"net"
 	"net/netip"
+	"time"
 
 	petname "github.com/dustinkirkland/golang-petname"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 
+	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
 	"github.com/cilium/cilium/pkg/identity"
 	"github.com/cilium/cilium/pkg/labels"
 	"github.com/cilium/cilium/pkg/lock"
@@ -19,33 +28,258 @@ import (
 const MaxServiceBackends = 50
 
 type random struct {
+	seed int64
+
+	mu  lock.Mutex
+	rng *rand.Rand
+	pet *petname.Generator
+	// zipfs are the zipf generators drawing from rng, by parameters, as
+	// expensive to construct.
+	zipfs map[zipfParams]*rand.Zipf
+
+	// namespaces and serviceAccounts, if set, are the pools the corresponding
+	// names are selected from.
+	namespaces, serviceAccounts []string
+
 	nodeIP4, nodeIP6 addr
 	podIP4, podIP6   addr
 	svcIP4, svcIP6   addr
 	cidr4, cidr6     prefix
 }
 
-func newRandom(cfg rndcfg) (rnd *random, err error) {
+func newRandom(log *slog.Logger, cfg rndcfg) (rnd *random, err error) {
 	defer func() {
 		if got := recover(); got != nil {
 			err = got.(error)
 		}
 	}()
 
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Info("Initializing random source. Use --seed to reproduce the same run", "seed", seed)
+
+	rng := rand.New(rand.NewSource(seed))
 	return &random{
-		nodeIP4: addr{addr: netip.MustParseAddr(cfg.RandomNodeIP4)},
-		nodeIP6: addr{addr: netip.MustParseAddr(cfg.RandomNodeIP6)},
-		podIP4:  addr{addr: netip.MustParseAddr(cfg.RandomPodIP4)},
-		podIP6:  addr{addr: netip.MustParseAddr(cfg.RandomPodIP6)},
-		svcIP4:  addr{addr: netip.MustParseAddr(cfg.RandomSvcIP4)},
-		svcIP6:  addr{addr: netip.MustParseAddr(cfg.RandomSvcIP6)},
-		cidr4:   prefix{pfx: netip.MustParsePrefix(cfg.RandomPodIP4 + "/28")},
-		cidr6:   prefix{pfx: netip.MustParsePrefix(cfg.RandomPodIP6 + "/120")},
+		seed:    seed,
+		rng:     rng,
+		pet:     petname.New(rng),
+		nodeIP4: newAddr(netip.MustParseAddr(cfg.RandomNodeIP4)),
+		nodeIP6: newAddr(netip.MustParseAddr(cfg.RandomNodeIP6)),
+		podIP4:  newAddr(netip.MustParseAddr(cfg.RandomPodIP4)),
+		podIP6:  newAddr(netip.MustParseAddr(cfg.RandomPodIP6)),
+		svcIP4:  newAddr(netip.MustParseAddr(cfg.RandomSvcIP4)),
+		svcIP6:  newAddr(netip.MustParseAddr(cfg.RandomSvcIP6)),
+		cidr4:   newPrefix(netip.MustParsePrefix(cfg.RandomPodIP4 + "/28")),
+		cidr6:   newPrefix(netip.MustParsePrefix(cfg.RandomPodIP6 + "/120")),
 	}, nil
 }
 
-func (r *random) Name() string      { return petname.Generate(2, "-") }
-func (r *random) Namespace() string { return petname.Name() }
+// validate checks that the addresses following the configured ones are enough
+// to reach the target number of objects of all clusters, as each random stream
+// allocates the addresses of a given kind interleaved with the other ones.
+func (cfg rndcfg) validate(specs []clusterSpec) error {
+	var (
+		v4, v6 bool
+		counts [len(allocators)]uint64
+	)
+
+	// counts are the maximum number of addresses of each kind concurrently
+	// allocated by a single stream.
+	for _, spec := range specs {
+		v4, v6 = v4 || spec.IPFamily.ipv4(), v6 || spec.IPFamily.ipv6()
+		backends := uint64(math.Ceil(float64(spec.Services.Target) * spec.ServiceShape.Backends.mean()))
+		counts[nodeIPs] = max(counts[nodeIPs], uint64(spec.Nodes.Target))
+		counts[podIPs] = max(counts[podIPs], 2*uint64(spec.Nodes.Target), uint64(spec.Endpoints.Target), backends)
+		counts[svcIPs] = max(counts[svcIPs], uint64(spec.Services.Target))
+		counts[podCIDRs] = max(counts[podCIDRs], uint64(spec.Nodes.Target))
+	}
+
+	for _, check := range []struct {
+		enabled bool
+		flag    string
+		first   string
+		kind    addrKind
+		bits    int
+	}{
+		{v4, "random-node-ip4", cfg.RandomNodeIP4, nodeIPs, 32},
+		{v6, "random-node-ip6", cfg.RandomNodeIP6, nodeIPs, 128},
+		{v4, "random-pod-ip4", cfg.RandomPodIP4, podIPs, 32},
+		{v6, "random-pod-ip6", cfg.RandomPodIP6, podIPs, 128},
+		{v4, "random-svc-ip4", cfg.RandomSvcIP4, svcIPs, 32},
+		{v6, "random-svc-ip6", cfg.RandomSvcIP6, svcIPs, 128},
+		{v4, "random-pod-ip4", cfg.RandomPodIP4, podCIDRs, 28},
+		{v6, "random-pod-ip6", cfg.RandomPodIP6, podCIDRs, 120},
+	} {
+		first, err := netip.ParseAddr(check.first)
+		if err != nil {
+			return fmt.Errorf("invalid --%s: %w", check.flag, err)
+		}
+
+		if !check.enabled {
+			continue
+		}
+
+		slots := uint64(len(specs) * len(allocators[check.kind]))
+		if hi, n := bits.Mul64(counts[check.kind], slots); hi != 0 ||
+			!advance(netip.PrefixFrom(first, check.bits), uint(n)).IsValid() {
+			return fmt.Errorf("the addresses following --%s=%s are not enough for %d clusters "+
+				"with up to %d objects each allocating them", check.flag, check.first, len(specs), counts[check.kind])
+		}
+	}
+
+	return nil
+}
+
+// Stream returns a new random source, deterministically derived from the
+// seed and the given name. Each stream is meant to be used by a single
+// goroutine, so that the sequence of generated values is reproducible.
+func (r *random) Stream(name string) *random {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+
+	seed := r.seed ^ int64(hash.Sum64())
+	rng := rand.New(rand.NewSource(seed))
+	return &random{
+		seed:    seed,
+		rng:     rng,
+		pet:     petname.New(rng),
+		nodeIP4: r.nodeIP4.interleaved(0, 1),
+		nodeIP6: r.nodeIP6.interleaved(0, 1),
+		podIP4:  r.podIP4.interleaved(0, 1),
+		podIP6:  r.podIP6.interleaved(0, 1),
+		svcIP4:  r.svcIP4.interleaved(0, 1),
+		svcIP6:  r.svcIP6.interleaved(0, 1),
+		cidr4:   r.cidr4.interleaved(0, 1),
+		cidr6:   r.cidr6.interleaved(0, 1),
+	}
+}
+
+// addrKind identifies a kind of addresses allocated by the random sources.
+type addrKind uint8
+
+const (
+	nodeIPs addrKind = iota
+	podIPs
+	svcIPs
+	podCIDRs
+)
+
+// Interleaved configures the addresses of the given kind allocated by the
+// stream to be interleaved with those of the other streams, according to its
+// slot and the total number of slots, so that they never overlap and do not
+// depend on the relative ordering of the allocations. It must be called
+// before allocating any address.
+func (r *random) Interleaved(kind addrKind, slot, slots uint) *random {
+	switch kind {
+	case nodeIPs:
+		r.nodeIP4, r.nodeIP6 = r.nodeIP4.interleaved(slot, slots), r.nodeIP6.interleaved(slot, slots)
+	case podIPs:
+		r.podIP4, r.podIP6 = r.podIP4.interleaved(slot, slots), r.podIP6.interleaved(slot, slots)
+	case svcIPs:
+		r.svcIP4, r.svcIP6 = r.svcIP4.interleaved(slot, slots), r.svcIP6.interleaved(slot, slots)
+	case podCIDRs:
+		r.cidr4, r.cidr6 = r.cidr4.interleaved(slot, slots), r.cidr6.interleaved(slot, slots)
+	}
+
+	return r
+}
+
+func (r *random) intn(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rng.Intn(n)
+}
+
+func (r *random) float64() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rng.Float64()
+}
+
+// zipf returns a value in [0, imax], drawn from a zipf distribution with the
+// given exponent.
+func (r *random) zipf(s float64, imax uint64) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	params := zipfParams{s: s, imax: imax}
+	z, ok := r.zipfs[params]
+	if !ok {
+		if r.zipfs == nil {
+			r.zipfs = make(map[zipfParams]*rand.Zipf)
+		}
+
+		z = rand.NewZipf(r.rng, s, 1, imax)
+		r.zipfs[params] = z
+	}
+
+	return z.Uint64()
+}
+
+type zipfParams struct {
+	s    float64
+	imax uint64
+}
+
+func (r *random) petname(words int, separator string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.pet.Generate(words, separator)
+}
+
+func (r *random) adjective() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.pet.Adjective()
+}
+
+// Pool returns n distinct names, deterministically derived from the seed and
+// the given name only, so that the same pool is shared by all clusters.
+func (r *random) Pool(name string, n uint) []string {
+	stream := r.Stream(name)
+	pool := make([]string, 0, n)
+	for i := range n {
+		pool = append(pool, fmt.Sprintf("%s-%d", stream.petname(1, ""), i))
+	}
+
+	return pool
+}
+
+// WithPools configures the pools the namespaces and service accounts are
+// selected from. Nil pools correspond to fresh random names.
+func (r *random) WithPools(namespaces, serviceAccounts []string) *random {
+	r.namespaces, r.serviceAccounts = namespaces, serviceAccounts
+	return r
+}
+
+// WithReserved configures the addresses and prefixes which must not be
+// allocated, as already in use. Nil reservations correspond to none.
+func (r *random) WithReserved(res *reservations) *random {
+	for _, a := range []*addr{&r.nodeIP4, &r.nodeIP6, &r.podIP4, &r.podIP6, &r.svcIP4, &r.svcIP6} {
+		a.reserved = res
+	}
+
+	r.cidr4.reserved, r.cidr6.reserved = res, res
+	return r
+}
+
+func (r *random) fromPool(pool []string) string {
+	if len(pool) == 0 {
+		return r.petname(1, "")
+	}
+
+	return pool[r.intn(len(pool))]
+}
+
+func (r *random) Name() string           { return r.petname(2, "-") }
+func (r *random) Namespace() string      { return r.fromPool(r.namespaces) }
+func (r *random) ServiceAccount() string { return r.fromPool(r.serviceAccounts) }
 
 func (r *random) NodeIP4() net.IP { return r.nodeIP4.Next() }
 func (r *random) NodeIP6() net.IP { return r.nodeIP6.Next() }
@@ -57,7 +291,7 @@ func (r *random) ServiceIP4() net.IP { return r.svcIP4.Next() }
 func (r *random) ServiceIP6() net.IP { return r.svcIP6.Next() }
 
 func (r *random) PodIP() net.IP {
-	if rand.Intn(2) == 1 {
+	if r.intn(2) == 1 {
 		return r.PodIP4()
 	}
 
@@ -67,9 +301,9 @@ func (r *random) PodIP() net.IP {
 func (r *random) CIDR4() *net.IPNet { return r.cidr4.Next() }
 func (r *random) CIDR6() *net.IPNet { return r.cidr6.Next() }
 
-func (r *random) Index(length int) int       { return rand.Intn(length) }
-func (r *random) ShouldUpdateUnlikely() bool { return rand.Intn(5) == 0 }
-func (r *random) ShouldUpdateLikely() bool   { return rand.Intn(100) != 0 }
+func (r *random) Index(length int) int       { return r.intn(length) }
+func (r *random) ShouldUpdateUnlikely() bool { return r.intn(5) == 0 }
+func (r *random) ShouldUpdateLikely() bool   { return r.intn(100) != 0 }
 
 // The probability of removing an object is current / (current + target).
 // This ensures that when current == target, the probability is 0.5.
@@ -77,82 +311,215 @@ func (r *random) ShouldUpdateLikely() bool   { return rand.Intn(100) != 0 }
 // it is < 0.5.
 func (r *random) ShouldRemove(current, target uint) bool {
 	if target == 0 {
-		return rand.Intn(2) == 1
+		return r.intn(2) == 1
 	}
 
-	return uint(rand.Intn(int(current+target))) < current
+	return uint(r.intn(int(current+target))) < current
 }
 
-func (r *random) Identity(cluster uint32) identity.NumericIdentity {
-	return identity.NumericIdentity(cluster<<16 + uint32(rand.Intn(65536-256)+256))
+// Weighted returns the index of one of the given weights, selected with
+// probability proportional to its value.
+func (r *random) Weighted(weights ...float64) int {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+
+	last, pick := len(weights)-1, r.float64()*total
+	for i, w := range weights {
+		if pick < w {
+			return i
+		}
+
+		pick -= w
+		if w > 0 {
+			// Guard against rounding errors, never returning zero weights.
+			last = i
+		}
+	}
+
+	return last
+}
+
+func (r *random) Identity(cluster cmtypes.ClusterInfo) identity.NumericIdentity {
+	bits := identityBits(cluster.MaxConnectedClusters)
+	return identity.NumericIdentity(cluster.ID<<bits + uint32(r.intn(1<<bits-256)+256))
 }
 
-func (r *random) IdentityLabels(cluster string) labels.LabelArray {
-	n := rand.Intn(8) + 1
+func (r *random) IdentityLabels(cluster string, shape identityShape) labels.LabelArray {
+	n := shape.Labels.sample(r)
 	lbls := make(labels.LabelArray, 0, n+4)
 
 	ns := r.Namespace()
 	lbls = append(lbls, labels.NewLabel("io.kubernetes.pod.namespace", ns, labels.LabelSourceK8s))
 	lbls = append(lbls, labels.NewLabel("io.cilium.k8s.namespace.labels.kubernetes.io/metadata.name", ns, labels.LabelSourceK8s))
-	lbls = append(lbls, labels.NewLabel("io.cilium.k8s.policy.serviceaccount", petname.Name(), labels.LabelSourceK8s))
+	lbls = append(lbls, labels.NewLabel("io.cilium.k8s.policy.serviceaccount", r.ServiceAccount(), labels.LabelSourceK8s))
 	lbls = append(lbls, labels.NewLabel("io.cilium.k8s.policy.cluster", cluster, labels.LabelSourceK8s))
 
-	for len(lbls) <= n {
-		lbls = append(lbls, labels.NewLabel(petname.Generate(3, "."), petname.Adjective(), labels.LabelSourceK8s))
+	if len(shape.Catalog) == 0 {
+		for range n {
+			lbls = append(lbls, labels.NewLabel(r.petname(3, "."), r.adjective(), labels.LabelSourceK8s))
+		}
+
+		return lbls
+	}
+
+	// Select the keys without replacement, hence the number of labels is
+	// capped to the size of the catalog.
+	weights := make([]float64, len(shape.Catalog))
+	for i, lbl := range shape.Catalog {
+		weights[i] = cmp.Or(lbl.Weight, 1)
+	}
+
+	for range min(n, uint(len(shape.Catalog))) {
+		i := r.Weighted(weights...)
+		lbl := shape.Catalog[i]
+		lbls = append(lbls, labels.NewLabel(lbl.Key, lbl.Values[r.intn(len(lbl.Values))], labels.LabelSourceK8s))
+		weights[i] = 0
 	}
 
 	return lbls
 }
 
-func (r *random) ServiceBackends() int { return rand.Intn(MaxServiceBackends) }
 func (r *random) ServiceLabels() map[string]string {
-	n := rand.Intn(6) + 1
+	n := r.intn(6) + 1
 	lbls := make(map[string]string, n)
 
 	for len(lbls) <= n {
-		lbls[petname.Generate(3, ".")] = petname.Adjective()
+		lbls[r.petname(3, ".")] = r.adjective()
 	}
 
 	return lbls
 }
 
 func (r *random) WireGuardPublicKey() (string, error) {
-	key, err := wgtypes.GeneratePrivateKey()
+	var raw [wgtypes.KeyLen]byte
+
+	r.mu.Lock()
+	r.rng.Read(raw[:])
+	r.mu.Unlock()
+
+	key, err := wgtypes.NewKey(raw[:])
 	if err != nil {
 		return "", err
 	}
 
+	// Clamp the random bytes to obtain a valid private key, as described in
+	// https://cr.yp.to/ecdh.html (same as wgtypes.GeneratePrivateKey).
+	key[0] &= 248
+	key[31] &= 127
+	key[31] |= 64
+
 	return key.PublicKey().String(), nil
 }
 
 type addr struct {
-	addr netip.Addr
-	mu   lock.Mutex
+	// first is the address the allocator started from, which it wraps
+	// around to once the address space got exhausted.
+	first    netip.Addr
+	addr     netip.Addr
+	stride   uint
+	reserved *reservations
+	mu       lock.Mutex
+}
+
+func newAddr(first netip.Addr) addr {
+	return addr{first: first, addr: first, stride: 1}
+}
+
+// interleaved returns a new allocator, starting from the same base address,
+// and returning the addresses corresponding to the given slot only.
+func (a *addr) interleaved(slot, slots uint) addr {
+	first := add(a.addr, uint64(slot))
+	return addr{first: first, addr: first, stride: slots}
 }
 
 func (a *addr) Next() net.IP {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	a.addr = a.addr.Next()
+	for next := true; next; next = a.reserved.hasAddr(a.addr) {
+		// Wrap around once the address space got exhausted, reusing the
+		// addresses released in the meanwhile, as the configured targets
+		// are validated to fit it.
+		if a.addr = add(a.addr, uint64(a.stride)); !a.addr.IsValid() {
+			a.addr = add(a.first, uint64(a.stride))
+		}
+	}
 	return a.addr.AsSlice()
 }
 
 type prefix struct {
-	pfx netip.Prefix
-	mu  lock.Mutex
+	// first is the prefix the allocator started from, which it wraps
+	// around to once the address space got exhausted.
+	first    netip.Prefix
+	pfx      netip.Prefix
+	stride   uint
+	reserved *reservations
+	mu       lock.Mutex
+}
+
+func newPrefix(first netip.Prefix) prefix {
+	return prefix{first: first, pfx: first, stride: 1}
+}
+
+// interleaved returns a new allocator, starting from the same base prefix,
+// and returning the prefixes corresponding to the given slot only.
+func (p *prefix) interleaved(slot, slots uint) prefix {
+	first := netip.PrefixFrom(advance(p.pfx, slot), p.pfx.Bits())
+	return prefix{first: first, pfx: first, stride: slots}
 }
 
 func (p *prefix) Next() *net.IPNet {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	next := p.pfx.Addr()
-	increment := 1 << (p.pfx.Addr().BitLen() - p.pfx.Bits())
-	for i := 0; i < increment; i++ {
-		next = next.Next()
+	for next := true; next; next = p.reserved.hasPrefix(p.pfx) {
+		// Wrap around once the address space got exhausted, as for the addresses.
+		if p.pfx = netip.PrefixFrom(advance(p.pfx, p.stride), p.pfx.Bits()); !p.pfx.IsValid() {
+			p.pfx = netip.PrefixFrom(advance(p.first, p.stride), p.first.Bits())
+		}
+	}
+
+	return &net.IPNet{IP: p.pfx.Addr().AsSlice(), Mask: net.CIDRMask(p.pfx.Bits(), p.pfx.Addr().BitLen())}
+}
+
+// advance returns the address of the n-th prefix following the given one.
+func advance(pfx netip.Prefix, n uint) netip.Addr {
+	hostBits := pfx.Addr().BitLen() - pfx.Bits()
+	if hostBits >= 64 || uint64(n) > math.MaxUint64>>hostBits {
+		return netip.Addr{}
+	}
+
+	return add(pfx.Addr(), uint64(n)<<hostBits)
+}
+
+// add returns the address following the given one by n positions. Same as
+// netip.Addr.Next, it returns the zero address in case of overflow.
+func add(a netip.Addr, n uint64) netip.Addr {
+	if !a.IsValid() {
+		return a
+	}
+
+	if a.Is4() {
+		raw := a.As4()
+		base := uint64(binary.BigEndian.Uint32(raw[:]))
+		if n > math.MaxUint32-base {
+			return netip.Addr{}
+		}
+
+		binary.BigEndian.PutUint32(raw[:], uint32(base+n))
+		return netip.AddrFrom4(raw)
+	}
+
+	raw := a.As16()
+	lo, carry := bits.Add64(binary.BigEndian.Uint64(raw[8:]), n, 0)
+	hi, carry := bits.Add64(binary.BigEndian.Uint64(raw[:8]), 0, carry)
+	if carry != 0 {
+		return netip.Addr{}
 	}
 
-	p.pfx = netip.PrefixFrom(next, p.pfx.Bits())
-	return &net.IPNet{IP: p.pfx.Addr().AsSlice(), Mask: net.CIDRMask(p.pfx.Bits(), next.BitLen())}
+	binary.BigEndian.PutUint64(raw[:8], hi)
+	binary.BigEndian.PutUint64(raw[8:], lo)
+	return netip.AddrFrom16(raw).WithZone(a.Zone())
 }
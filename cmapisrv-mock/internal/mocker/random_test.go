@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAddressWrap(t *testing.T) {
+	root := newAddr(netip.MustParseAddr("255.255.255.250"))
+	a := root.interleaved(1, 2)
+
+	// The allocator wraps around to the first address of its slot once the
+	// address space got exhausted, rather than returning invalid addresses.
+	var got []string
+	for range 4 {
+		got = append(got, a.Next().String())
+	}
+
+	expected := []string{"255.255.255.253", "255.255.255.255", "255.255.255.253", "255.255.255.255"}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("Unexpected addresses, expected %v, got %v", expected, got)
+		}
+	}
+
+	root6 := newPrefix(netip.MustParsePrefix("ffff:ffff:ffff:ffff:ffff:ffff:ffff:fe00/120"))
+	p := root6.interleaved(0, 1)
+	if first, second := p.Next().String(), p.Next().String(); first != "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ff00/120" || second != first {
+		t.Fatalf("Unexpected prefixes, got %s and %s", first, second)
+	}
+}
+
+func TestRandomConfigValidation(t *testing.T) {
+	cfg := testConfig()
+	specs, err := newClusterSpecs(cfg)
+	if err != nil {
+		t.Fatalf("Failed to build the cluster specs: %v", err)
+	}
+
+	if err := defaultRndcfg.validate(specs); err != nil {
+		t.Errorf("Default configuration unexpectedly rejected: %v", err)
+	}
+
+	rcfg := defaultRndcfg
+	rcfg.RandomSvcIP4 = "255.255.255.250"
+	if err := rcfg.validate(specs); err == nil {
+		t.Error("Service addresses overflowing the address space unexpectedly accepted")
+	}
+
+	rcfg = defaultRndcfg
+	rcfg.RandomNodeIP6 = "invalid"
+	if err := rcfg.validate(specs); err == nil {
+		t.Error("Invalid node address unexpectedly accepted")
+	}
+}
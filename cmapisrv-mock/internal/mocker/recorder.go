@@ -0,0 +1,147 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cilium/hive/cell"
+	"github.com/cilium/hive/job"
+	"github.com/spf13/pflag"
+
+	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	nodeStore "github.com/cilium/cilium/pkg/node/store"
+)
+
+type recorderConfig struct {
+	Output   string
+	Prefixes []string
+}
+
+var defaultRecorderConfig = recorderConfig{
+	Prefixes: []string{
+		nodeStore.NodeStorePrefix,
+		IdentitiesPath,
+		IPIdentitiesPath,
+		serviceStore.ServiceStorePrefix,
+	},
+}
+
+func (def recorderConfig) Flags(flags *pflag.FlagSet) {
+	flags.String("output", def.Output, "Path of the file the recorded events are written to")
+	flags.StringSlice("prefixes", def.Prefixes, "The kvstore prefixes to record")
+}
+
+func (cfg recorderConfig) validate() error {
+	if cfg.Output == "" {
+		return errors.New("the output file must be specified")
+	}
+
+	return nil
+}
+
+func registerRecorder(in struct {
+	cell.In
+
+	Logger   *slog.Logger
+	JobGroup job.Group
+
+	Config  recorderConfig
+	Backend kvstore.Client
+}) {
+	in.JobGroup.Add(job.OneShot("recorder", func(ctx context.Context, _ cell.Health) error {
+		file, err := os.Create(in.Config.Output)
+		if err != nil {
+			return fmt.Errorf("creating output file: %w", err)
+		}
+
+		rec := newRecorder(in.Logger, in.Backend, in.Config.Prefixes, file)
+		rec.Run(ctx)
+
+		return file.Close()
+	}))
+}
+
+// recorder watches a set of kvstore prefixes, and writes all the observed
+// events to the output, so that they can be subsequently replayed.
+type recorder struct {
+	log      *slog.Logger
+	backend  kvstore.BackendOperations
+	prefixes []string
+
+	mu      lock.Mutex
+	encoder *json.Encoder
+	count   uint
+}
+
+func newRecorder(log *slog.Logger, backend kvstore.BackendOperations, prefixes []string, out io.Writer) *recorder {
+	return &recorder{
+		log:      log,
+		backend:  backend,
+		prefixes: prefixes,
+		encoder:  json.NewEncoder(out),
+	}
+}
+
+// Run records the events until the context is canceled.
+func (rec *recorder) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	rec.log.Info("Starting recording", "prefixes", rec.prefixes)
+	for _, prefix := range rec.prefixes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec.watch(ctx, prefix)
+		}()
+	}
+
+	wg.Wait()
+	rec.log.Info("Recording completed", "events", rec.count)
+}
+
+func (rec *recorder) watch(ctx context.Context, prefix string) {
+	var (
+		log     = rec.log.With(logfields.Prefix, prefix)
+		initial = true
+	)
+
+	for ev := range rec.backend.ListAndWatch(ctx, prefix) {
+		recorded := recordedEvent{Time: time.Now(), Key: ev.Key, Initial: initial}
+
+		switch ev.Typ {
+		case kvstore.EventTypeListDone:
+			log.Info("Initial listing completed")
+			initial = false
+			continue
+		case kvstore.EventTypeDelete:
+			recorded.Type = recordedDelete
+		default:
+			recorded.Type, recorded.Value = recordedUpsert, string(ev.Value)
+		}
+
+		if err := rec.write(recorded); err != nil {
+			log.Error("Failed to record event", logfields.Error, err)
+		}
+	}
+}
+
+func (rec *recorder) write(ev recordedEvent) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.count++
+	return rec.encoder.Encode(ev)
+}
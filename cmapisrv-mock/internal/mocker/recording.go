@@ -0,0 +1,108 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+type recordedEventType string
+
+const (
+	recordedUpsert = recordedEventType("upsert")
+	recordedDelete = recordedEventType("delete")
+)
+
+// recordedEvent is a single kvstore event, as stored in the recording file
+// (one JSON object per line).
+type recordedEvent struct {
+	// Time is the instant the event was observed.
+	Time time.Time `json:"time"`
+	// Type is the type of the event (upsert|delete).
+	Type recordedEventType `json:"type"`
+	// Key is the full kvstore key.
+	Key string `json:"key"`
+	// Value is the value associated with the key (unset for deletions).
+	Value string `json:"value,omitempty"`
+	// Initial is true if the event is part of the initial listing, rather
+	// than a subsequent modification observed while watching.
+	Initial bool `json:"initial,omitempty"`
+}
+
+// recording is the sequence of events read from a recording file.
+type recording struct {
+	events []recordedEvent
+
+	// pods and hosts are the spans of the recorded pod addresses (i.e., the
+	// ones of endpoints and service backends, and the ones allocated to the
+	// nodes from their pod CIDRs), and of the recorded host addresses. They
+	// determine the offset the addresses are shifted by when replayed by each
+	// cluster, so that they never overlap.
+	pods, hosts addrSpans
+}
+
+// newRecording reads the recording to be replayed, if configured.
+func newRecording(cfg config) (*recording, error) {
+	if cfg.Replay == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(cfg.Replay)
+	if err != nil {
+		return nil, fmt.Errorf("opening recording: %w", err)
+	}
+	defer file.Close()
+
+	rec, err := readRecording(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading recording %q: %w", cfg.Replay, err)
+	}
+
+	return rec, nil
+}
+
+func readRecording(r io.Reader) (*recording, error) {
+	var (
+		rec     recording
+		decoder = json.NewDecoder(r)
+	)
+
+	for {
+		var ev recordedEvent
+		if err := decoder.Decode(&ev); err != nil {
+			if errors.Is(err, io.EOF) {
+				rec.pods, rec.hosts, err = recordedSpans(rec.events)
+				if err != nil {
+					return nil, err
+				}
+
+				return &rec, nil
+			}
+
+			return nil, fmt.Errorf("event %d: %w", len(rec.events)+1, err)
+		}
+
+		switch ev.Type {
+		case recordedUpsert, recordedDelete:
+		default:
+			return nil, fmt.Errorf("event %d: unsupported type %q", len(rec.events)+1, ev.Type)
+		}
+
+		rec.events = append(rec.events, ev)
+	}
+}
+
+// start returns the instant the recording started.
+func (rec *recording) start() time.Time {
+	if len(rec.events) == 0 {
+		return time.Time{}
+	}
+
+	return rec.events[0].Time
+}
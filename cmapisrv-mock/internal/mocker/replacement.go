@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"golang.org/x/time/rate"
+)
+
+type endpointsPolicy string
+
+const (
+	endpointsPolicyMove   = endpointsPolicy("move")
+	endpointsPolicyRemove = endpointsPolicy("remove")
+)
+
+// nodeReplacement configures the rolling replacement of the nodes of a cluster,
+// as it happens during an upgrade.
+type nodeReplacement struct {
+	// QPS is the number of nodes replaced per second (disabled if zero).
+	QPS float64 `json:"qps"`
+	// Endpoints configures whether the endpoints hosted on a replaced node
+	// are moved to the new node, or removed (move|remove).
+	Endpoints endpointsPolicy `json:"endpoints"`
+}
+
+func (nr nodeReplacement) validate() error {
+	if nr.QPS < 0 {
+		return fmt.Errorf("node replacement: qps must not be negative")
+	}
+
+	switch nr.Endpoints {
+	case endpointsPolicyMove, endpointsPolicyRemove:
+		return nil
+	default:
+		return fmt.Errorf("node replacement: unsupported endpoints policy %q; must be one of move|remove", nr.Endpoints)
+	}
+}
+
+// replacer replaces the nodes of a cluster one at a time. Differently from the
+// independent churn of nodes and endpoints, the endpoints hosted on the old node
+// are either moved to the new one, or removed.
+type replacer struct {
+	log       *slog.Logger
+	cfg       nodeReplacement
+	nodes     *nodes
+	endpoints *endpoints
+}
+
+func newReplacer(log *slog.Logger, cfg nodeReplacement, nodes *nodes, endpoints *endpoints) *replacer {
+	return &replacer{
+		log:       log.With("type", "node-replacement"),
+		cfg:       cfg,
+		nodes:     nodes,
+		endpoints: endpoints,
+	}
+}
+
+func (r *replacer) Run(ctx context.Context, allSynced <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-allSynced:
+	}
+
+	r.log.Info("Starting rolling node replacement", "qps", r.cfg.QPS, "endpoints", r.cfg.Endpoints)
+	rl := rate.NewLimiter(rate.Limit(r.cfg.QPS), 1)
+	for rl.Wait(ctx) == nil {
+		// The replacement is part of the churn of the nodes, hence it is
+		// paused together with it.
+		if r.nodes.ctrl.stepWhenResumed(ctx, func() { r.replace(ctx) }) != nil {
+			return
+		}
+	}
+}
+
+func (r *replacer) replace(ctx context.Context) {
+	r.nodes.mu.Lock()
+	defer r.nodes.mu.Unlock()
+
+	old, ok := r.nodes.cache.Get(r.nodes.rnd)
+	if !ok {
+		return
+	}
+
+	// Add the replacement before removing the old node, so that the cache
+	// never gets empty, as it is concurrently read to place the endpoints.
+	replacement := r.nodes.new()
+	for !r.nodes.cache.Add(replacement) {
+		replacement = r.nodes.new()
+	}
+	r.nodes.cache.Delete(old.GetKeyName())
+
+	r.log.Debug("Replacing node", "old", old.Name, "new", replacement.Name)
+
+	if r.cfg.Endpoints == endpointsPolicyMove {
+		// The new node needs to exist before moving the endpoints to it.
+		r.nodes.do(ctx, replacement, false)
+		r.endpoints.MoveFrom(ctx, hostIP(old), hostIP(replacement))
+		r.nodes.do(ctx, old, true)
+		return
+	}
+
+	r.endpoints.RemoveFrom(ctx, hostIP(old))
+	r.nodes.do(ctx, old, true)
+	r.nodes.do(ctx, replacement, false)
+}
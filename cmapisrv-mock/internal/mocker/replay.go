@@ -0,0 +1,569 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/bits"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cilium/cilium/pkg/cidr"
+	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
+	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	"github.com/cilium/cilium/pkg/node/addressing"
+	nodeStore "github.com/cilium/cilium/pkg/node/store"
+	nodeTypes "github.com/cilium/cilium/pkg/node/types"
+)
+
+// rewriteFn converts a recorded key (relative to the recorded prefix) and
+// value into the corresponding ones for the cluster of the given replayer.
+// The value is empty in case of deletions.
+type rewriteFn func(rp *replayer, key string, value []byte) (string, []byte, error)
+
+// replayResource describes how to replay the events of a given resource type.
+type replayResource struct {
+	typ      string
+	prefix   string
+	newStore func(cp cparams) store.SyncStore
+	rewrite  rewriteFn
+}
+
+var replayResources = []replayResource{
+	{typ: "nodes", prefix: nodeStore.NodeStorePrefix, newStore: newNodesStore, rewrite: rewriteNode},
+	{typ: "identities", prefix: IdentitiesPath, newStore: newIdentitiesStore, rewrite: rewriteIdentity},
+	{typ: "ips", prefix: IPIdentitiesPath, newStore: newEndpointsStore, rewrite: rewriteEndpoint},
+	{typ: "services", prefix: serviceStore.ServiceStorePrefix, newStore: newServicesStore, rewrite: rewriteService},
+}
+
+var errSkipEvent = errors.New("event not replayable")
+
+// replayer replays a recording in the context of a mocked cluster, writing
+// the events through the same SyncStores used to generate random churn.
+type replayer struct {
+	log     *slog.Logger
+	cinfo   cmtypes.ClusterInfo
+	slot    uint
+	rec     *recording
+	speed   float64
+	stores  map[string]store.SyncStore
+	metrics map[string]resourceMetrics
+	errors  *errorTracker
+	// objects are the keys currently replayed, by resource type.
+	objects map[string]map[string]struct{}
+}
+
+func newReplayer(log *slog.Logger, cp cparams) *replayer {
+	rp := &replayer{
+		log:     log,
+		cinfo:   cp.cluster,
+		slot:    cp.slot,
+		rec:     cp.recording,
+		speed:   cp.replaySpeed,
+		stores:  make(map[string]store.SyncStore),
+		metrics: make(map[string]resourceMetrics),
+		errors:  cp.errors,
+		objects: make(map[string]map[string]struct{}),
+	}
+
+	for _, res := range replayResources {
+		rp.stores[res.typ] = res.newStore(cp)
+		rp.metrics[res.typ] = cp.metrics.resource(cp.cluster.Name, res.typ)
+		rp.objects[res.typ] = make(map[string]struct{})
+	}
+
+	return rp
+}
+
+func (rp *replayer) Run(ctx context.Context, synced func(context.Context), allSynced <-chan struct{}) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	rp.log.Info("Starting replay", "events", len(rp.rec.events))
+	for _, ss := range rp.stores {
+		wg.Add(1)
+		go func() {
+			ss.Run(ctx)
+			wg.Done()
+		}()
+	}
+
+	for _, ev := range rp.rec.events {
+		if ev.Initial {
+			rp.replay(ctx, ev)
+		}
+	}
+
+	var swg sync.WaitGroup
+	for _, ss := range rp.stores {
+		swg.Add(1)
+		ss.Synced(ctx, func(context.Context) { swg.Done() })
+	}
+
+	// Synced does not invoke the callback if the context is canceled.
+	done := make(chan struct{})
+	go func() { swg.Wait(); close(done) }()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-done:
+		rp.log.Info("Initial synchronization completed")
+		synced(ctx)
+	}
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-allSynced:
+	}
+
+	// The events are replayed preserving the original timing (scaled by the
+	// configured speed factor), relative to the beginning of the recording.
+	start, origin := time.Now(), rp.rec.start()
+	for _, ev := range rp.rec.events {
+		if ev.Initial {
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(start.Add(time.Duration(float64(ev.Time.Sub(origin)) / rp.speed))))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		rp.replay(ctx, ev)
+	}
+
+	rp.log.Info("Replay completed")
+	<-ctx.Done()
+}
+
+func (rp *replayer) replay(ctx context.Context, ev recordedEvent) {
+	for _, res := range replayResources {
+		key, ok := strings.CutPrefix(ev.Key, res.prefix+"/")
+		if !ok {
+			continue
+		}
+
+		key, value, err := res.rewrite(rp, key, []byte(ev.Value))
+		if err != nil {
+			if !errors.Is(err, errSkipEvent) {
+				rp.log.Warn("Failed to replay event", logfields.Key, ev.Key, logfields.Error, err)
+			}
+			return
+		}
+
+		ss, kv, objects := rp.stores[res.typ], store.NewKVPair(key, string(value)), rp.objects[res.typ]
+		defer func() { rp.metrics[res.typ].objects.Set(float64(len(objects))) }()
+
+		if ev.Type == recordedDelete {
+			rp.log.Debug("Deleting key", "key", key, "type", res.typ)
+			if err := ss.DeleteKey(ctx, kv); err != nil {
+				rp.log.Error("Failed to delete key", logfields.Error, err)
+				rp.errors.failed(operationDelete, err)
+			}
+			delete(objects, key)
+			return
+		}
+
+		rp.log.Debug("Upserting key", "key", key, "type", res.typ)
+		if err := ss.UpsertKey(ctx, kv); err != nil {
+			rp.log.Error("Failed to upsert key", logfields.Error, err)
+			rp.errors.failed(operationUpsert, err)
+		}
+		objects[key] = struct{}{}
+		return
+	}
+}
+
+// replayIdentity converts a cluster-scoped identity to the corresponding one
+// of the given cluster, leaving reserved identities untouched.
+func replayIdentity(id identity.NumericIdentity, cluster cmtypes.ClusterInfo) identity.NumericIdentity {
+	if id.IsReservedIdentity() {
+		return id
+	}
+
+	bits := identityBits(cluster.MaxConnectedClusters)
+	return identity.NumericIdentity(cluster.ID<<bits | uint32(id)&(1<<bits-1))
+}
+
+// addrSpans are the number of IPv4 and IPv6 addresses covered by a set of
+// recorded addresses, rounded up to the next power of two.
+type addrSpans struct {
+	v4, v6 uint64
+}
+
+// of returns the span of the family of the given address.
+func (s addrSpans) of(addr netip.Addr) uint64 {
+	if addr.Is4() {
+		return s.v4
+	}
+	return s.v6
+}
+
+// remap converts a recorded address into the corresponding one of the cluster,
+// shifting it by a per-cluster offset, which is a multiple of the given spans,
+// so that the addresses replayed by different clusters do not conflict. The
+// first cluster replays the recorded addresses unmodified.
+func (rp *replayer) remap(spans addrSpans, addr netip.Addr) (netip.Addr, error) {
+	hi, offset := bits.Mul64(uint64(rp.slot), spans.of(addr))
+	if remapped := add(addr, offset); hi == 0 && remapped.IsValid() {
+		return remapped, nil
+	}
+
+	return netip.Addr{}, fmt.Errorf("address %s overflows once remapped", addr)
+}
+
+// remapString is like remap, but for addresses in string form.
+func (rp *replayer) remapString(spans addrSpans, ip string) (string, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", fmt.Errorf("parsing address: %w", err)
+	}
+
+	remapped, err := rp.remap(spans, addr)
+	return remapped.String(), err
+}
+
+// remapIP is like remap, but for net.IP addresses, which are left untouched
+// if unset.
+func (rp *replayer) remapIP(spans addrSpans, ip net.IP) (net.IP, error) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ip, nil
+	}
+
+	remapped, err := rp.remap(spans, addr.Unmap())
+	return net.IP(remapped.AsSlice()), err
+}
+
+// remapCIDR is like remap, but for pod CIDRs, which are left untouched if
+// unset. The remapped CIDRs are still aligned, as the spans cover them.
+func (rp *replayer) remapCIDR(c *cidr.CIDR) (*cidr.CIDR, error) {
+	if c == nil || c.IPNet == nil {
+		return c, nil
+	}
+
+	ip, err := rp.remapIP(rp.rec.pods, c.IP)
+	if err != nil {
+		return nil, err
+	}
+
+	return cidr.NewCIDR(&net.IPNet{IP: ip, Mask: c.Mask}), nil
+}
+
+// addrRange tracks the range covered by a set of addresses, per family.
+type addrRange struct {
+	first4, last4, first6, last6 netip.Addr
+}
+
+func (r *addrRange) track(addr netip.Addr) {
+	addr = addr.Unmap()
+	first, last := &r.first6, &r.last6
+	if addr.Is4() {
+		first, last = &r.first4, &r.last4
+	}
+
+	if !first.IsValid() || addr.Less(*first) {
+		*first = addr
+	}
+	if !last.IsValid() || last.Less(addr) {
+		*last = addr
+	}
+}
+
+func (r *addrRange) trackString(ip string) {
+	// Invalid addresses are reported when replaying the event.
+	if addr, err := netip.ParseAddr(ip); err == nil {
+		r.track(addr)
+	}
+}
+
+func (r *addrRange) trackIP(ip net.IP) {
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		r.track(addr)
+	}
+}
+
+func (r *addrRange) trackCIDR(c *cidr.CIDR) {
+	if c == nil || c.IPNet == nil {
+		return
+	}
+
+	first, ok := netip.AddrFromSlice(c.IP.Mask(c.Mask))
+	if !ok {
+		return
+	}
+
+	// Set all the host bits to get the last address of the CIDR.
+	ones, _ := c.Mask.Size()
+	first = first.Unmap()
+	last := first.As16()
+	for i := 128 - first.BitLen() + ones; i < 128; i++ {
+		last[i/8] |= 0x80 >> (i % 8)
+	}
+
+	r.track(first)
+	r.track(netip.AddrFrom16(last))
+}
+
+func (r *addrRange) spans() (spans addrSpans, err error) {
+	if spans.v4, err = addrSpan(r.first4, r.last4); err != nil {
+		return addrSpans{}, err
+	}
+	if spans.v6, err = addrSpan(r.first6, r.last6); err != nil {
+		return addrSpans{}, err
+	}
+
+	return spans, nil
+}
+
+// recordedSpans returns the spans of the recorded pod and host addresses.
+func recordedSpans(events []recordedEvent) (pods, hosts addrSpans, err error) {
+	var podRange, hostRange addrRange
+	for _, ev := range events {
+		if key, ok := strings.CutPrefix(ev.Key, IPIdentitiesPath+"/"); ok {
+			if _, ip, ok := strings.Cut(key, "/"); ok {
+				podRange.trackString(ip)
+			}
+
+			var pair identity.IPIdentityPair
+			if ev.Type == recordedUpsert && json.Unmarshal([]byte(ev.Value), &pair) == nil {
+				hostRange.trackIP(pair.HostIP)
+			}
+		}
+
+		if strings.HasPrefix(ev.Key, serviceStore.ServiceStorePrefix+"/") && ev.Type == recordedUpsert {
+			var svc serviceStore.ClusterService
+			if json.Unmarshal([]byte(ev.Value), &svc) == nil {
+				for ip := range svc.Backends {
+					podRange.trackString(ip)
+				}
+			}
+		}
+
+		if strings.HasPrefix(ev.Key, nodeStore.NodeStorePrefix+"/") && ev.Type == recordedUpsert {
+			var node nodeTypes.Node
+			if json.Unmarshal([]byte(ev.Value), &node) == nil {
+				for _, addr := range node.IPAddresses {
+					if addr.Type == addressing.NodeCiliumInternalIP {
+						podRange.trackIP(addr.IP)
+					} else {
+						hostRange.trackIP(addr.IP)
+					}
+				}
+
+				for _, ip := range []net.IP{node.IPv4HealthIP, node.IPv6HealthIP, node.IPv4IngressIP, node.IPv6IngressIP} {
+					podRange.trackIP(ip)
+				}
+				for _, c := range append([]*cidr.CIDR{node.IPv4AllocCIDR, node.IPv6AllocCIDR},
+					append(node.IPv4SecondaryAllocCIDRs, node.IPv6SecondaryAllocCIDRs...)...) {
+					podRange.trackCIDR(c)
+				}
+			}
+		}
+	}
+
+	if pods, err = podRange.spans(); err != nil {
+		return addrSpans{}, addrSpans{}, err
+	}
+	if hosts, err = hostRange.spans(); err != nil {
+		return addrSpans{}, addrSpans{}, err
+	}
+
+	return pods, hosts, nil
+}
+
+// addrSpan returns the number of addresses in the given range, rounded up to
+// the next power of two.
+func addrSpan(first, last netip.Addr) (uint64, error) {
+	if !first.IsValid() {
+		return 0, nil
+	}
+
+	f, l := first.As16(), last.As16()
+	lo, borrow := bits.Sub64(binary.BigEndian.Uint64(l[8:]), binary.BigEndian.Uint64(f[8:]), 0)
+	hi, _ := bits.Sub64(binary.BigEndian.Uint64(l[:8]), binary.BigEndian.Uint64(f[:8]), borrow)
+	if hi != 0 || bits.Len64(lo) == 64 {
+		return 0, fmt.Errorf("the recorded addresses between %s and %s span a too large range to be remapped", first, last)
+	}
+
+	return 1 << bits.Len64(lo), nil
+}
+
+// rewriteNode converts "<cluster>/<node>" keys, and the associated node.
+func rewriteNode(rp *replayer, key string, value []byte) (string, []byte, error) {
+	_, name, ok := strings.Cut(key, "/")
+	if !ok {
+		return "", nil, errSkipEvent
+	}
+
+	if len(value) == 0 {
+		return path.Join(rp.cinfo.Name, name), nil, nil
+	}
+
+	var node nodeTypes.Node
+	if err := json.Unmarshal(value, &node); err != nil {
+		return "", nil, fmt.Errorf("unmarshaling node: %w", err)
+	}
+
+	if err := rp.remapNode(&node); err != nil {
+		return "", nil, err
+	}
+
+	node.Cluster, node.ClusterID = rp.cinfo.Name, rp.cinfo.ID
+	value, err := json.Marshal(&node)
+	return path.Join(rp.cinfo.Name, name), value, err
+}
+
+// remapNode remaps the addresses of the given node, consistently with the ones
+// of the endpoints it hosts.
+func (rp *replayer) remapNode(node *nodeTypes.Node) (err error) {
+	for i, addr := range node.IPAddresses {
+		spans := rp.rec.hosts
+		if addr.Type == addressing.NodeCiliumInternalIP {
+			spans = rp.rec.pods
+		}
+
+		if node.IPAddresses[i].IP, err = rp.remapIP(spans, addr.IP); err != nil {
+			return err
+		}
+	}
+
+	for _, ip := range []*net.IP{&node.IPv4HealthIP, &node.IPv6HealthIP, &node.IPv4IngressIP, &node.IPv6IngressIP} {
+		if *ip, err = rp.remapIP(rp.rec.pods, *ip); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range []**cidr.CIDR{&node.IPv4AllocCIDR, &node.IPv6AllocCIDR} {
+		if *c, err = rp.remapCIDR(*c); err != nil {
+			return err
+		}
+	}
+
+	for _, cidrs := range [][]*cidr.CIDR{node.IPv4SecondaryAllocCIDRs, node.IPv6SecondaryAllocCIDRs} {
+		for i := range cidrs {
+			if cidrs[i], err = rp.remapCIDR(cidrs[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rewriteIdentity converts "id/<identity>" keys, and the associated labels.
+// The other keys (i.e., the ones used for the reverse lookup) are skipped, as
+// not cached by KVStoreMesh.
+func rewriteIdentity(rp *replayer, key string, value []byte) (string, []byte, error) {
+	id, ok := strings.CutPrefix(key, "id/")
+	if !ok {
+		return "", nil, errSkipEvent
+	}
+
+	parsed, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return "", nil, fmt.Errorf("parsing identity: %w", err)
+	}
+
+	key = replayIdentity(identity.NumericIdentity(parsed), rp.cinfo).String()
+	if len(value) == 0 {
+		return key, nil, nil
+	}
+
+	const clusterLabel = "k8s:io.cilium.k8s.policy.cluster="
+	lbls := strings.Split(strings.TrimSuffix(string(value), ";"), ";")
+	for i, lbl := range lbls {
+		if strings.HasPrefix(lbl, clusterLabel) {
+			lbls[i] = clusterLabel + rp.cinfo.Name
+		}
+	}
+
+	return key, []byte(strings.Join(lbls, ";") + ";"), nil
+}
+
+// rewriteEndpoint converts "<address-space>/<ip>" keys, and the associated
+// IP/identity pair.
+func rewriteEndpoint(rp *replayer, key string, value []byte) (string, []byte, error) {
+	_, ip, ok := strings.Cut(key, "/")
+	if !ok {
+		return "", nil, errSkipEvent
+	}
+
+	ip, err := rp.remapString(rp.rec.pods, ip)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(value) == 0 {
+		return ip, nil, nil
+	}
+
+	var pair identity.IPIdentityPair
+	if err := json.Unmarshal(value, &pair); err != nil {
+		return "", nil, fmt.Errorf("unmarshaling IP/identity pair: %w", err)
+	}
+
+	if pair.IP != nil {
+		pair.IP = net.ParseIP(ip)
+	}
+
+	// The host IP is remapped like the addresses of the nodes, so that the
+	// endpoints keep referring to the node hosting them.
+	if pair.HostIP, err = rp.remapIP(rp.rec.hosts, pair.HostIP); err != nil {
+		return "", nil, err
+	}
+
+	pair.ID = replayIdentity(pair.ID, rp.cinfo)
+	value, err = json.Marshal(&pair)
+	return ip, value, err
+}
+
+// rewriteService converts "<cluster>/<namespace>/<name>" keys, and the
+// associated service.
+func rewriteService(rp *replayer, key string, value []byte) (string, []byte, error) {
+	_, name, ok := strings.Cut(key, "/")
+	if !ok {
+		return "", nil, errSkipEvent
+	}
+
+	if len(value) == 0 {
+		return path.Join(rp.cinfo.Name, name), nil, nil
+	}
+
+	var svc serviceStore.ClusterService
+	if err := json.Unmarshal(value, &svc); err != nil {
+		return "", nil, fmt.Errorf("unmarshaling service: %w", err)
+	}
+
+	backends := make(map[string]serviceStore.PortConfiguration, len(svc.Backends))
+	for ip, ports := range svc.Backends {
+		remapped, err := rp.remapString(rp.rec.pods, ip)
+		if err != nil {
+			return "", nil, err
+		}
+		backends[remapped] = ports
+	}
+
+	svc.Cluster, svc.ClusterID, svc.Backends = rp.cinfo.Name, rp.cinfo.ID, backends
+	value, err := json.Marshal(&svc)
+	return path.Join(rp.cinfo.Name, name), value, err
+}
@@ -0,0 +1,197 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cilium/statedb"
+
+	"github.com/cilium/cilium/pkg/cidr"
+	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
+	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
+	"github.com/cilium/cilium/pkg/identity"
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/node/addressing"
+	nodeTypes "github.com/cilium/cilium/pkg/node/types"
+)
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(10 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func mustMarshal(t *testing.T, obj any) string {
+	t.Helper()
+
+	data, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatalf("Failed to marshal %v: %v", obj, err)
+	}
+	return string(data)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	var (
+		ctx = context.Background()
+		log = slog.New(slog.DiscardHandler)
+		src = kvstore.NewInMemoryClient(statedb.New(), "source")
+		dst = kvstore.NewInMemoryClient(statedb.New(), "target")
+		out bytes.Buffer
+	)
+
+	initial := map[string]string{
+		"cilium/state/nodes/v1/orig/foo": mustMarshal(t, &nodeTypes.Node{
+			Name: "foo", Cluster: "orig", ClusterID: 9}),
+		"cilium/state/nodes/v1/orig/bar": mustMarshal(t, &nodeTypes.Node{
+			Name: "bar", Cluster: "orig", ClusterID: 9,
+			IPAddresses: []nodeTypes.Address{
+				{Type: addressing.NodeInternalIP, IP: net.ParseIP("192.168.1.10")},
+				{Type: addressing.NodeExternalIP, IP: net.ParseIP("192.168.1.11")},
+				{Type: addressing.NodeCiliumInternalIP, IP: net.ParseIP("10.0.0.4")},
+			},
+			IPv4AllocCIDR: cidr.MustParseCIDR("10.0.0.0/28"),
+			IPv4HealthIP:  net.ParseIP("10.0.0.5")}),
+		"cilium/state/identities/v1/id/589930":              "k8s:app=foo;k8s:io.cilium.k8s.policy.cluster=orig;",
+		"cilium/state/identities/v1/value/k8s:app=foo;/1.2": "589930",
+		"cilium/state/ip/v1/default/10.0.0.1": mustMarshal(t, &identity.IPIdentityPair{
+			HostIP: net.ParseIP("192.168.1.10"), ID: 589930}),
+		"cilium/state/services/v1/orig/ns/svc": mustMarshal(t, &serviceStore.ClusterService{
+			Cluster: "orig", ClusterID: 9, Namespace: "ns", Name: "svc",
+			Backends: map[string]serviceStore.PortConfiguration{"10.0.0.1": {}}}),
+		"cilium/state/unrelated/v1/foo": "bar",
+	}
+
+	for key, value := range initial {
+		if err := src.Update(ctx, key, []byte(value), false); err != nil {
+			t.Fatalf("Failed to write key %q: %v", key, err)
+		}
+	}
+
+	rctx, cancel := context.WithCancel(ctx)
+	rec := newRecorder(log, src, defaultRecorderConfig.Prefixes, &out)
+	recorded := func(n uint) func() bool {
+		return func() bool {
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			return rec.count == n
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		rec.Run(rctx)
+		close(done)
+	}()
+
+	eventually(t, "initial events to be recorded", recorded(6))
+
+	if err := src.Delete(ctx, "cilium/state/nodes/v1/orig/foo"); err != nil {
+		t.Fatalf("Failed to delete key: %v", err)
+	}
+	if err := src.Update(ctx, "cilium/state/ip/v1/default/10.0.0.2", []byte(mustMarshal(t, &identity.IPIdentityPair{ID: 2})), false); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	eventually(t, "subsequent events to be recorded", recorded(8))
+	cancel()
+	<-done
+
+	recording, err := readRecording(&out)
+	if err != nil {
+		t.Fatalf("Failed to read recording: %v", err)
+	}
+
+	if len(recording.events) != 8 {
+		t.Fatalf("Unexpected number of recorded events, expected 8, got %d", len(recording.events))
+	}
+
+	for _, ev := range recording.events {
+		if ev.Initial != (ev.Type == recordedUpsert && ev.Key != "cilium/state/ip/v1/default/10.0.0.2") {
+			t.Errorf("Unexpected initial flag for event %+v", ev)
+		}
+	}
+
+	synced := make(chan struct{})
+	allSynced := make(chan struct{})
+	close(allSynced)
+
+	rctx, cancel = context.WithCancel(ctx)
+	defer cancel()
+
+	// The addresses are shifted according to the slot of the cluster, and
+	// the range of the recorded pod (10.0.0.0-10.0.0.15, including the pod
+	// CIDR of the node) and host (192.168.1.10-192.168.1.11) ones.
+	rp := newReplayer(log, cparams{
+		cluster:     cmtypes.ClusterInfo{ID: 3, Name: "replayed"},
+		slot:        3,
+		factory:     store.NewFactory(log, store.MetricsProvider()),
+		backend:     dst,
+		recording:   recording,
+		replaySpeed: 10,
+		metrics:     newMetrics(),
+		errors:      newErrorTracker(log, defaultConfig, nil, newMetrics()),
+	})
+	go rp.Run(rctx, func(context.Context) { close(synced) }, allSynced)
+
+	select {
+	case <-synced:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for the initial synchronization")
+	}
+
+	expected := map[string]string{
+		"cilium/cache/nodes/v1/replayed/bar": mustMarshal(t, &nodeTypes.Node{
+			Name: "bar", Cluster: "replayed", ClusterID: 3,
+			IPAddresses: []nodeTypes.Address{
+				{Type: addressing.NodeInternalIP, IP: net.ParseIP("192.168.1.16")},
+				{Type: addressing.NodeExternalIP, IP: net.ParseIP("192.168.1.17")},
+				{Type: addressing.NodeCiliumInternalIP, IP: net.ParseIP("10.0.0.52")},
+			},
+			IPv4AllocCIDR: cidr.MustParseCIDR("10.0.0.48/28"),
+			IPv4HealthIP:  net.ParseIP("10.0.0.53")}),
+		"cilium/cache/identities/v1/replayed/id/196714": "k8s:app=foo;k8s:io.cilium.k8s.policy.cluster=replayed;",
+		"cilium/cache/ip/v1/replayed/10.0.0.49": mustMarshal(t, &identity.IPIdentityPair{
+			HostIP: net.ParseIP("192.168.1.16"), ID: 196714}),
+		"cilium/cache/ip/v1/replayed/10.0.0.50": mustMarshal(t, &identity.IPIdentityPair{
+			ID: 2}),
+		"cilium/cache/services/v1/replayed/ns/svc": mustMarshal(t, &serviceStore.ClusterService{
+			Cluster: "replayed", ClusterID: 3, Namespace: "ns", Name: "svc",
+			Backends: map[string]serviceStore.PortConfiguration{"10.0.0.49": {}}}),
+	}
+
+	eventually(t, "the events to be replayed", func() bool {
+		kvs, _ := dst.ListPrefix(ctx, "cilium/cache/")
+		if len(kvs) != len(expected) {
+			return false
+		}
+
+		for key, value := range expected {
+			if string(kvs[key].Data) != value {
+				return false
+			}
+		}
+		return true
+	})
+
+	for _, prefix := range []string{"nodes", "identities", "ip", "services"} {
+		key := "cilium/synced/replayed/cilium/cache/" + prefix + "/v1"
+		if value, _ := dst.Get(ctx, key); value == nil {
+			t.Errorf("Missing synced canary %q", key)
+		}
+	}
+}
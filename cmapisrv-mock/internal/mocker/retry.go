@@ -0,0 +1,247 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cilium/hive"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/lock"
+	"github.com/cilium/cilium/pkg/logging/logfields"
+)
+
+// errorTracker keeps track of the failed kvstore operations, and shuts down
+// the mocker if the number of failures within the configured window exceeds
+// the error budget.
+type errorTracker struct {
+	log        *slog.Logger
+	cfg        config
+	shutdowner hive.Shutdowner
+	metrics    *mockerMetrics
+
+	mu lock.Mutex
+	// total is the total number of failures.
+	total uint
+	// recent are the instants of the failures within the budget window.
+	recent []time.Time
+	// failing is the number of operations currently being retried.
+	failing   uint
+	lastError string
+	lastTime  time.Time
+	exhausted bool
+}
+
+type errorStatus struct {
+	// Total is the total number of failed kvstore operations.
+	Total uint `json:"total"`
+	// Recent is the number of failures within the budget window.
+	Recent uint `json:"recent"`
+	// Budget is the number of failures tolerated within the window (unlimited if zero).
+	Budget uint `json:"budget"`
+	// Window is the duration of the budget window.
+	Window string `json:"window"`
+	// Failing is the number of operations currently being retried.
+	Failing uint `json:"failing"`
+	// LastError is the last observed error, if any.
+	LastError string     `json:"lastError,omitempty"`
+	LastTime  *time.Time `json:"lastTime,omitempty"`
+}
+
+func newErrorTracker(log *slog.Logger, cfg config, shutdowner hive.Shutdowner, metrics *mockerMetrics) *errorTracker {
+	return &errorTracker{
+		log:        log,
+		cfg:        cfg,
+		shutdowner: shutdowner,
+		metrics:    metrics,
+	}
+}
+
+// failed records the failure of the given operation, and shuts down the
+// mocker if the error budget got exhausted.
+func (et *errorTracker) failed(op string, err error) {
+	et.metrics.Failures.WithLabelValues(op).Inc()
+
+	et.mu.Lock()
+	defer et.mu.Unlock()
+
+	now := time.Now()
+	et.total++
+	et.lastError, et.lastTime = fmt.Sprintf("%s: %s", op, err), now
+	et.recent = append(et.trim(now), now)
+
+	if et.cfg.ErrorBudget == 0 || uint(len(et.recent)) <= et.cfg.ErrorBudget || et.exhausted {
+		return
+	}
+
+	et.exhausted = true
+	et.log.Error("Error budget exhausted, giving up",
+		logfields.Error, err,
+		"budget", et.cfg.ErrorBudget,
+		"window", et.cfg.ErrorBudgetWindow,
+	)
+	et.shutdowner.Shutdown(hive.ShutdownWithError(
+		fmt.Errorf("more than %d failed kvstore operations within %s, last: %w",
+			et.cfg.ErrorBudget, et.cfg.ErrorBudgetWindow, err)))
+}
+
+// trim returns the recent failures, discarding the ones outside of the window.
+// It must be called with the mutex held.
+func (et *errorTracker) trim(now time.Time) []time.Time {
+	idx := 0
+	for idx < len(et.recent) && now.Sub(et.recent[idx]) > et.cfg.ErrorBudgetWindow {
+		idx++
+	}
+
+	return et.recent[idx:]
+}
+
+func (et *errorTracker) retrying(delta int) {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+
+	et.failing = uint(int(et.failing) + delta)
+}
+
+// healthy returns whether no operations are currently being retried.
+func (et *errorTracker) healthy() bool {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+
+	return et.failing == 0
+}
+
+func (et *errorTracker) status() errorStatus {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+
+	et.recent = et.trim(time.Now())
+	st := errorStatus{
+		Total:     et.total,
+		Recent:    uint(len(et.recent)),
+		Budget:    et.cfg.ErrorBudget,
+		Window:    et.cfg.ErrorBudgetWindow.String(),
+		Failing:   et.failing,
+		LastError: et.lastError,
+	}
+
+	if !et.lastTime.IsZero() {
+		st.LastTime = &et.lastTime
+	}
+
+	return st
+}
+
+// kvstoreErrors handles the requests to retrieve the failures of the kvstore
+// operations, and the status of the error budget.
+func (mk *mocker) kvstoreErrors(w http.ResponseWriter, r *http.Request) {
+	mk.reply(w, r, http.StatusOK, mk.errs.status())
+}
+
+// retryingBackend wraps a kvstore backend, keeping track of the failed write
+// operations, which are then retried with exponential backoff by the sync
+// stores. Each failed operation is accounted against the error budget once,
+// regardless of the number of attempts required for it to succeed.
+type retryingBackend struct {
+	kvstore.BackendOperations
+
+	log     *slog.Logger
+	tracker *errorTracker
+
+	mu lock.Mutex
+	// failing are the keys whose last write operation failed, and the
+	// corresponding number of failed attempts.
+	failing map[string]uint
+}
+
+func newRetryingBackend(log *slog.Logger, backend kvstore.BackendOperations, tracker *errorTracker) kvstore.BackendOperations {
+	return &retryingBackend{
+		BackendOperations: backend,
+		log:               log,
+		tracker:           tracker,
+		failing:           make(map[string]uint),
+	}
+}
+
+func (rb *retryingBackend) Update(ctx context.Context, key string, value []byte, lease bool) error {
+	return rb.track(ctx, "update", key, rb.BackendOperations.Update(ctx, key, value, lease))
+}
+
+func (rb *retryingBackend) UpdateIfDifferent(ctx context.Context, key string, value []byte, lease bool) (recreated bool, err error) {
+	recreated, err = rb.BackendOperations.UpdateIfDifferent(ctx, key, value, lease)
+	return recreated, rb.track(ctx, "update", key, err)
+}
+
+func (rb *retryingBackend) Delete(ctx context.Context, key string) error {
+	return rb.track(ctx, "delete", key, rb.BackendOperations.Delete(ctx, key))
+}
+
+func (rb *retryingBackend) DeletePrefix(ctx context.Context, path string) error {
+	err := rb.track(ctx, "delete", path, rb.BackendOperations.DeletePrefix(ctx, path))
+	if err != nil {
+		return err
+	}
+
+	// The failed operations on the deleted keys are not retried anymore
+	// once the corresponding cluster got disconnected.
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	for key := range rb.failing {
+		if strings.HasPrefix(key, path) {
+			delete(rb.failing, key)
+			rb.tracker.retrying(-1)
+		}
+	}
+
+	return nil
+}
+
+// track records the outcome of the write operation on the given key, and
+// returns the corresponding error, for the caller to retry it if appropriate.
+func (rb *retryingBackend) track(ctx context.Context, op, key string, err error) error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	attempts, failing := rb.failing[key]
+	switch {
+	case err == nil || ctx.Err() != nil:
+		// The operation is not retried anymore if the context got canceled.
+		if !failing {
+			return err
+		}
+
+		delete(rb.failing, key)
+		rb.tracker.retrying(-1)
+		if err == nil {
+			rb.log.Info("Kvstore operation succeeded after retrying", logfields.Key, key, logfields.Attempt, attempts+1)
+		}
+
+	case !failing:
+		rb.failing[key] = 1
+		rb.tracker.retrying(1)
+		rb.tracker.failed(op, err)
+		rb.log.Warn("Failed to perform kvstore operation, retrying", logfields.Error, err, logfields.Key, key)
+
+	default:
+		rb.failing[key] = attempts + 1
+	}
+
+	return err
+}
+
+// withRetryBackoff returns the option configuring the sync stores to retry
+// the failed operations with exponential backoff between min and max. The
+// option constructor is passed in to infer the type of the workqueue keys.
+func withRetryBackoff[K comparable](opt func(workqueue.TypedRateLimiter[K]) store.WSSOpt, min, max time.Duration) store.WSSOpt {
+	return opt(workqueue.NewTypedItemExponentialFailureRateLimiter[K](min, max))
+}
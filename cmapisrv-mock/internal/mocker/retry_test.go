@@ -0,0 +1,188 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cilium/hive"
+	"github.com/cilium/statedb"
+
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+)
+
+// flakyBackend fails the given number of write operations, before succeeding.
+type flakyBackend struct {
+	kvstore.BackendOperations
+	failures atomic.Int32
+}
+
+func (fb *flakyBackend) Update(ctx context.Context, key string, value []byte, lease bool) error {
+	if fb.failures.Add(-1) >= 0 {
+		return errors.New("transient failure")
+	}
+
+	return fb.BackendOperations.Update(ctx, key, value, lease)
+}
+
+type fakeShutdowner struct {
+	err chan error
+}
+
+func (fs *fakeShutdowner) Shutdown(opts ...hive.ShutdownOption) {
+	fs.err <- errors.New("shutdown")
+}
+
+func newTestRetryingBackend(t *testing.T, cfg config, failures int32) (kvstore.BackendOperations, *errorTracker, *fakeShutdowner) {
+	t.Helper()
+
+	log := slog.New(slog.DiscardHandler)
+	fb := &flakyBackend{BackendOperations: kvstore.NewInMemoryClient(statedb.New(), "mocker")}
+	fb.failures.Store(failures)
+
+	sd := &fakeShutdowner{err: make(chan error, 1)}
+	tracker := newErrorTracker(log, cfg, sd, newMetrics())
+	return newRetryingBackend(log, fb, tracker), tracker, sd
+}
+
+func TestRetryingBackend(t *testing.T) {
+	backend, tracker, sd := newTestRetryingBackend(t, defaultConfig, 5)
+
+	// The failed operation is returned to the caller to be retried, while
+	// being accounted as a single failure, regardless of the attempts.
+	for range 5 {
+		if err := backend.Update(context.Background(), "foo", []byte("bar"), false); err == nil {
+			t.Fatal("Update unexpectedly succeeded")
+		}
+
+		if st := tracker.status(); st.Total != 1 || st.Recent != 1 || st.Failing != 1 || st.LastError == "" {
+			t.Fatalf("Unexpected error status: %+v", st)
+		}
+
+		if tracker.healthy() {
+			t.Fatal("Tracker unexpectedly healthy while the operation is failing")
+		}
+	}
+
+	if err := backend.Update(context.Background(), "foo", []byte("bar"), false); err != nil {
+		t.Fatalf("Update failed after the transient failures: %v", err)
+	}
+
+	if value, err := backend.Get(context.Background(), "foo"); err != nil || string(value) != "bar" {
+		t.Fatalf("Unexpected value after retries, got %q (err: %v)", value, err)
+	}
+
+	if st := tracker.status(); st.Total != 1 || st.Failing != 0 {
+		t.Fatalf("Unexpected error status: %+v", st)
+	}
+
+	if !tracker.healthy() {
+		t.Fatal("Tracker unexpectedly unhealthy after recovery")
+	}
+
+	select {
+	case <-sd.err:
+		t.Fatal("Unexpected shutdown with unlimited error budget")
+	default:
+	}
+}
+
+func TestRetryingBackendCanceled(t *testing.T) {
+	backend, tracker, _ := newTestRetryingBackend(t, defaultConfig, 1000)
+
+	if err := backend.Update(context.Background(), "foo", []byte("bar"), false); err == nil {
+		t.Fatal("Update unexpectedly succeeded")
+	}
+
+	// The operation is not retried anymore once the context got canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := backend.Update(ctx, "foo", []byte("bar"), false); err == nil {
+		t.Fatal("Update unexpectedly succeeded")
+	}
+
+	if !tracker.healthy() {
+		t.Fatal("Tracker unexpectedly unhealthy after the operation got canceled")
+	}
+
+	// Nor if the corresponding prefix got deleted, e.g., as the cluster got
+	// disconnected in the meanwhile.
+	if err := backend.Update(context.Background(), "foo/bar", []byte("bar"), false); err == nil {
+		t.Fatal("Update unexpectedly succeeded")
+	}
+
+	if err := backend.DeletePrefix(context.Background(), "foo/"); err != nil {
+		t.Fatalf("DeletePrefix failed: %v", err)
+	}
+
+	if st := tracker.status(); st.Total != 2 || st.Failing != 0 {
+		t.Fatalf("Unexpected error status: %+v", st)
+	}
+}
+
+func TestErrorBudget(t *testing.T) {
+	cfg := defaultConfig
+	cfg.ErrorBudget, cfg.ErrorBudgetWindow = 10, time.Minute
+	backend, tracker, sd := newTestRetryingBackend(t, cfg, 1000)
+
+	// The attempts to perform the same operation count once.
+	for range 100 {
+		backend.Update(context.Background(), "foo", []byte("bar"), false)
+	}
+
+	select {
+	case <-sd.err:
+		t.Fatal("Unexpected shutdown after a single failed operation")
+	default:
+	}
+
+	for i := range cfg.ErrorBudget {
+		backend.Update(context.Background(), fmt.Sprintf("foo-%d", i), []byte("bar"), false)
+	}
+
+	select {
+	case <-sd.err:
+	default:
+		t.Fatal("Error budget unexpectedly not exhausted")
+	}
+
+	if st := tracker.status(); st.Recent != cfg.ErrorBudget+1 {
+		t.Fatalf("Unexpected error status: %+v", st)
+	}
+}
+
+func TestRetryingSyncStore(t *testing.T) {
+	cfg := defaultConfig
+	cfg.RetryMinBackoff, cfg.RetryMaxBackoff = time.Millisecond, 10*time.Millisecond
+	backend, tracker, _ := newTestRetryingBackend(t, cfg, 5)
+
+	log := slog.New(slog.DiscardHandler)
+	ss := store.NewFactory(log, store.MetricsProvider()).NewSyncStore("foo", backend, "prefix",
+		withRetryBackoff(store.WSSWithRateLimiter, cfg.RetryMinBackoff, cfg.RetryMaxBackoff))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ss.Run(ctx)
+
+	// The sync store retries the failed operation, which is accounted once.
+	if err := ss.UpsertKey(ctx, store.NewKVPair("bar", "baz")); err != nil {
+		t.Fatalf("UpsertKey failed: %v", err)
+	}
+
+	eventually(t, "the key to be written", func() bool {
+		value, err := backend.Get(ctx, "prefix/bar")
+		return err == nil && string(value) == "baz"
+	})
+
+	if st := tracker.status(); st.Total != 1 || st.Failing != 0 {
+		t.Fatalf("Unexpected error status: %+v", st)
+	}
+}
@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/cilium/cilium/pkg/logging/logfields"
+	nodeTypes "github.com/cilium/cilium/pkg/node/types"
+)
+
+// maxIPSecKeyIndex is the maximum IPsec key index, as the SPI is encoded in
+// four bits, and zero is reserved.
+const maxIPSecKeyIndex = 15
+
+// keyRotation configures the periodic rotation of the encryption keys of a
+// cluster: IPsec rotations update the key index of all nodes and endpoints,
+// while WireGuard rotations replace the public key of all nodes.
+type keyRotation struct {
+	// Interval is the interval between the beginning of subsequent rotations
+	// (disabled if zero).
+	Interval duration `json:"interval"`
+	// QPS is the number of nodes (together with the hosted endpoints, in case
+	// of IPsec) switching to the new key per second, during each rotation.
+	QPS float64 `json:"qps"`
+}
+
+func (kr keyRotation) validate() error {
+	if kr.Interval < 0 {
+		return errors.New("key rotation: interval must not be negative")
+	}
+
+	if kr.Interval > 0 && kr.QPS <= 0 {
+		return errors.New("key rotation: qps must be positive when the interval is set")
+	}
+
+	return nil
+}
+
+// encryptionKey tracks the IPsec key index currently in use in a cluster.
+type encryptionKey struct {
+	current atomic.Uint32
+}
+
+func newEncryptionKey(mode encryptionMode) *encryptionKey {
+	key := &encryptionKey{}
+	key.current.Store(uint32(mode.toKey()))
+	return key
+}
+
+func (k *encryptionKey) get() uint8 { return uint8(k.current.Load()) }
+
+// rotate switches to the next key index, and returns it.
+func (k *encryptionKey) rotate() uint8 {
+	next := k.get()%maxIPSecKeyIndex + 1
+	k.current.Store(uint32(next))
+	return next
+}
+
+// rotator periodically rotates the encryption keys of a cluster, switching one
+// node at a time to the new key, as it happens when the new key is propagated
+// to all agents.
+type rotator struct {
+	log        *slog.Logger
+	cfg        keyRotation
+	encryption encryptionMode
+	key        *encryptionKey
+	nodes      *nodes
+	endpoints  *endpoints
+}
+
+func newRotator(log *slog.Logger, cfg keyRotation, encryption encryptionMode,
+	key *encryptionKey, nodes *nodes, endpoints *endpoints) *rotator {
+	return &rotator{
+		log:        log.With("type", "key-rotation", "encryption", encryption),
+		cfg:        cfg,
+		encryption: encryption,
+		key:        key,
+		nodes:      nodes,
+		endpoints:  endpoints,
+	}
+}
+
+func (r *rotator) Run(ctx context.Context, allSynced <-chan struct{}) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-allSynced:
+	}
+
+	r.log.Info("Starting periodic key rotation", "interval", time.Duration(r.cfg.Interval), "qps", r.cfg.QPS)
+	ticker := time.NewTicker(time.Duration(r.cfg.Interval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.rotate(ctx)
+	}
+}
+
+func (r *rotator) rotate(ctx context.Context) {
+	var (
+		key   uint8
+		log   = r.log
+		start = time.Now()
+	)
+
+	if r.encryption == encryptionModeIPSec {
+		// New nodes and endpoints immediately use the new key.
+		key = r.key.rotate()
+		log = log.With("key", key)
+	}
+
+	log.Info("Starting key rotation", "nodes", r.nodes.cache.Len())
+
+	// Nodes created during the rotation already use the new key, while nodes
+	// deleted in the meanwhile are skipped.
+	rl := rate.NewLimiter(rate.Limit(r.cfg.QPS), 1)
+	for _, node := range r.nodes.cache.Select(func(*nodeTypes.Node) bool { return true }) {
+		if rl.Wait(ctx) != nil {
+			return
+		}
+
+		if r.nodes.ctrl.stepWhenResumed(ctx, func() { r.switchNode(ctx, node.GetKeyName(), key) }) != nil {
+			return
+		}
+	}
+
+	log.Info("Key rotation completed", "duration", time.Since(start))
+}
+
+func (r *rotator) switchNode(ctx context.Context, key string, index uint8) {
+	r.nodes.mu.Lock()
+	defer r.nodes.mu.Unlock()
+
+	current, ok := r.nodes.cache.Lookup(key)
+	if !ok {
+		return
+	}
+
+	updated := *current
+	switch r.encryption {
+	case encryptionModeIPSec:
+		updated.EncryptionKey = index
+	case encryptionModeWireGuard:
+		pubkey, err := r.nodes.rnd.WireGuardPublicKey()
+		if err != nil {
+			r.log.Error("Failed to generate WireGuard key", logfields.Error, err)
+			return
+		}
+
+		updated.WireguardPubKey = pubkey
+	}
+
+	r.log.Debug("Switching node to the new key", "node", updated.Name)
+	r.nodes.cache.Upsert(&updated)
+	r.nodes.do(ctx, &updated, false)
+
+	if r.encryption == encryptionModeIPSec {
+		// The hosted endpoints follow the key used by the node.
+		r.endpoints.RekeyFrom(ctx, hostIP(&updated), index)
+	}
+}
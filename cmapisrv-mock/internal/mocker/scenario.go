@@ -0,0 +1,406 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
+)
+
+type ipFamily string
+
+const (
+	ipFamilyIPv4 = ipFamily("ipv4")
+	ipFamilyIPv6 = ipFamily("ipv6")
+	ipFamilyDual = ipFamily("dual")
+)
+
+func (f ipFamily) validate() error {
+	switch f {
+	case ipFamilyIPv4, ipFamilyIPv6, ipFamilyDual:
+		return nil
+	default:
+		return fmt.Errorf("unsupported IP family %q; must be one of ipv4|ipv6|dual", f)
+	}
+}
+
+func (f ipFamily) ipv4() bool { return f != ipFamilyIPv6 }
+func (f ipFamily) ipv6() bool { return f != ipFamilyIPv4 }
+
+// count returns the number of enabled IP families.
+func (f ipFamily) count() uint {
+	if f == ipFamilyDual {
+		return 2
+	}
+	return 1
+}
+
+const defaultClusterNameFormat = "cluster-%03d"
+
+// resource configures the number of objects of a given type to mock, and the
+// rate of the associated create/update/delete operations at run-time, possibly
+// modulated over time by a churn profile.
+type resource struct {
+	Target  uint
+	QPS     float64
+	Profile profile
+}
+
+// clusterSpec describes a single mocked cluster.
+type clusterSpec struct {
+	ID       uint32
+	Name     string
+	IPFamily ipFamily
+	Schedule schedule
+	Faults   []faultSpec
+
+	ClusterConfig clusterConfigSpec
+
+	Nodes      resource
+	Identities resource
+	Endpoints  resource
+	Services   resource
+
+	ServiceExports resource
+
+	ServiceShape    serviceShape
+	IdentityShape   identityShape
+	NodeReplacement nodeReplacement
+	KeyRotation     keyRotation
+}
+
+// scenario is the representation of the scenario file, which describes a set
+// of heterogeneous mocked clusters. Any unset value defaults to the one
+// configured through the corresponding command line flag.
+type scenario struct {
+	Clusters []scenarioClusters `json:"clusters"`
+}
+
+// scenarioClusters describes a group of clusters sharing the same configuration.
+type scenarioClusters struct {
+	// FirstID is the cluster ID of the first cluster of the group.
+	FirstID uint32 `json:"firstID"`
+	// Count is the number of clusters in the group (defaults to 1).
+	Count uint32 `json:"count"`
+	// Name is the format string used to generate the name of each cluster,
+	// given its cluster ID (defaults to cluster-%03d). It is used verbatim
+	// if it does not contain any formatting verb.
+	Name string `json:"name"`
+	// IPFamily is the IP family of the mocked addresses (ipv4|ipv6|dual).
+	IPFamily ipFamily `json:"ipFamily"`
+	// Schedule configures when the clusters join and leave the mesh.
+	Schedule schedule `json:"schedule"`
+	// Faults configures the faults injected into the clusters over time.
+	Faults []faultSpec `json:"faults"`
+	// ClusterConfig overrides the individual settings of the advertised
+	// ClusterConfig, to emulate clusters running different Cilium versions.
+	ClusterConfig scenarioClusterConfig `json:"clusterConfig"`
+
+	Nodes      scenarioResource `json:"nodes"`
+	Identities scenarioResource `json:"identities"`
+	Endpoints  scenarioResource `json:"endpoints"`
+	Services   scenarioResource `json:"services"`
+
+	// ServiceExports configures the MCS-API exports of the global services.
+	ServiceExports scenarioResource `json:"serviceExports"`
+
+	// ServiceShape configures the ports, the number of backends and the
+	// kind of the mocked services. Each of the ports, backends and mix
+	// settings, if set, overrides the default one as a whole.
+	ServiceShape serviceShape `json:"serviceShape"`
+	// IdentityShape configures the labels of the mocked identities, and the
+	// pools of namespaces and service accounts. Each setting, if set,
+	// overrides the default one.
+	IdentityShape identityShape `json:"identityShape"`
+	// NodeReplacement configures the rolling replacement of the nodes.
+	NodeReplacement *nodeReplacement `json:"nodeReplacement"`
+	// KeyRotation configures the periodic rotation of the encryption keys.
+	KeyRotation *keyRotation `json:"keyRotation"`
+}
+
+type scenarioResource struct {
+	Target  *uint    `json:"target"`
+	QPS     *float64 `json:"qps"`
+	Profile *profile `json:"profile"`
+}
+
+func (sr scenarioResource) resolve(def resource) resource {
+	if sr.Target != nil {
+		def.Target = *sr.Target
+	}
+
+	if sr.QPS != nil {
+		def.QPS = *sr.QPS
+	}
+
+	if sr.Profile != nil {
+		def.Profile = *sr.Profile
+	}
+
+	return def
+}
+
+// newClusterSpecs returns the specifications of the clusters to be mocked,
+// either parsing the configured scenario file, or generating a uniform set
+// of clusters based on the command line flags.
+func newClusterSpecs(cfg config) ([]clusterSpec, error) {
+	specs, err := readClusterSpecs(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Plain clustermesh-apiservers do not scope identities and endpoints by
+	// cluster name, hence multiple clusters would overwrite each other.
+	if cfg.DirectMode && len(specs) > 1 &&
+		!strings.Contains(cfg.DirectEtcdConfig, clusterPlaceholder) &&
+		!strings.Contains(cfg.DirectKeyPrefix, clusterPlaceholder) {
+		return nil, fmt.Errorf("mocking multiple clusters in direct mode requires either the etcd configuration "+
+			"or the key prefix to be per-cluster (i.e., to contain %s)", clusterPlaceholder)
+	}
+
+	// Identities are allocated on demand by the pods in the pod lifecycle mode.
+	if cfg.PodLifecycle {
+		for _, spec := range specs {
+			if spec.Identities.QPS != 0 {
+				return nil, fmt.Errorf("cluster %q: the identities QPS is not supported in the pod lifecycle mode, "+
+					"as identities are allocated on demand by the pods", spec.Name)
+			}
+		}
+	}
+
+	// Agents connected to the same etcd instance share the same heartbeat.
+	if len(specs) > 1 && !cfg.dedicatedBackends() {
+		for _, spec := range specs {
+			if slices.ContainsFunc(spec.Faults, func(fs faultSpec) bool { return fs.Type == faultHeartbeat }) {
+				return nil, fmt.Errorf("cluster %q: the heartbeat fault requires each cluster to be "+
+					"associated with a dedicated etcd instance or key prefix in direct mode", spec.Name)
+			}
+		}
+	}
+
+	return specs, nil
+}
+
+func readClusterSpecs(cfg config) ([]clusterSpec, error) {
+	if cfg.Scenario == "" {
+		specs := cfg.uniformClusterSpecs()
+		for _, spec := range specs {
+			if err := spec.validate(); err != nil {
+				return nil, err
+			}
+		}
+
+		return specs, nil
+	}
+
+	data, err := os.ReadFile(cfg.Scenario)
+	if err != nil {
+		return nil, fmt.Errorf("reading scenario file: %w", err)
+	}
+
+	var sc scenario
+	if err := yaml.UnmarshalStrict(data, &sc); err != nil {
+		return nil, fmt.Errorf("parsing scenario file %q: %w", cfg.Scenario, err)
+	}
+
+	specs, err := sc.clusterSpecs(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scenario file %q: %w", cfg.Scenario, err)
+	}
+
+	return specs, nil
+}
+
+func (cfg config) uniformClusterSpecs() []clusterSpec {
+	var specs []clusterSpec
+	for i := uint(0); i < cfg.Clusters; i++ {
+		id := cfg.FirstClusterID + i
+		specs = append(specs, cfg.clusterSpec(uint32(id), fmt.Sprintf(defaultClusterNameFormat, id)))
+	}
+
+	return specs
+}
+
+func (cfg config) clusterSpec(id uint32, name string) clusterSpec {
+	family := ipFamily(cfg.IPFamily)
+	if family == "" {
+		family = ipFamilyIPv4
+		if cfg.EnableIPv6 {
+			family = ipFamilyDual
+		}
+	}
+
+	return clusterSpec{
+		ID:       id,
+		Name:     name,
+		IPFamily: family,
+
+		ClusterConfig: clusterConfigSpec{
+			Omit:                 cfg.OmitClusterConfig,
+			SyncedCanaries:       true,
+			MaxConnectedClusters: cfg.MaxConnectedClusters,
+			// Use the KVStoreMesh API to allow simulating multiple clusters
+			// using a single etcd instance, unless in direct mode.
+			Cached: !cfg.DirectMode,
+		},
+
+		Nodes:      resource{Target: cfg.Nodes, QPS: cfg.NodesQPS},
+		Identities: resource{Target: cfg.Identities, QPS: cfg.IdentitiesQPS},
+		Endpoints:  resource{Target: cfg.Endpoints, QPS: cfg.EndpointsQPS},
+		Services:   resource{Target: cfg.Services, QPS: cfg.ServicesQPS},
+
+		ServiceExports: resource{Target: cfg.ServiceExports, QPS: cfg.ServiceExportsQPS},
+
+		ServiceShape:  defaultServiceShape,
+		IdentityShape: defaultIdentityShape,
+		NodeReplacement: nodeReplacement{
+			QPS:       cfg.NodeReplacementQPS,
+			Endpoints: endpointsPolicy(cfg.NodeReplacementEndpoints),
+		},
+		KeyRotation: keyRotation{
+			Interval: duration(cfg.KeyRotationInterval),
+			QPS:      cfg.KeyRotationQPS,
+		},
+	}
+}
+
+func (sc scenario) clusterSpecs(cfg config) ([]clusterSpec, error) {
+	var (
+		specs = make([]clusterSpec, 0, len(sc.Clusters))
+		ids   = make(map[uint32]struct{})
+		names = make(map[string]struct{})
+	)
+
+	if len(sc.Clusters) == 0 {
+		return nil, errors.New("no clusters specified")
+	}
+
+	for _, group := range sc.Clusters {
+		count := max(group.Count, 1)
+		format := group.Name
+		if format == "" {
+			format = defaultClusterNameFormat
+		}
+
+		if count > 1 && !strings.Contains(format, "%") {
+			return nil, fmt.Errorf("name %q must contain a formatting verb when count is greater than one", format)
+		}
+
+		for id := group.FirstID; id < group.FirstID+count; id++ {
+			name := format
+			if strings.Contains(format, "%") {
+				name = fmt.Sprintf(format, id)
+			}
+
+			spec := cfg.clusterSpec(id, name)
+			if group.IPFamily != "" {
+				spec.IPFamily = group.IPFamily
+			}
+
+			spec.Schedule = group.Schedule
+			spec.Faults = group.Faults
+			spec.ClusterConfig = group.ClusterConfig.resolve(spec.ClusterConfig)
+
+			spec.Nodes = group.Nodes.resolve(spec.Nodes)
+			spec.Identities = group.Identities.resolve(spec.Identities)
+			spec.Endpoints = group.Endpoints.resolve(spec.Endpoints)
+			spec.Services = group.Services.resolve(spec.Services)
+			spec.ServiceExports = group.ServiceExports.resolve(spec.ServiceExports)
+			spec.ServiceShape = group.ServiceShape.resolve(spec.ServiceShape)
+			spec.IdentityShape = group.IdentityShape.resolve(spec.IdentityShape)
+
+			if group.NodeReplacement != nil {
+				spec.NodeReplacement.QPS = group.NodeReplacement.QPS
+				spec.NodeReplacement.Endpoints = cmp.Or(group.NodeReplacement.Endpoints, spec.NodeReplacement.Endpoints)
+			}
+
+			if group.KeyRotation != nil {
+				spec.KeyRotation.Interval = group.KeyRotation.Interval
+				spec.KeyRotation.QPS = cmp.Or(group.KeyRotation.QPS, spec.KeyRotation.QPS)
+			}
+
+			if err := spec.validate(); err != nil {
+				return nil, err
+			}
+
+			if _, ok := ids[spec.ID]; ok {
+				return nil, fmt.Errorf("duplicate cluster ID %d", spec.ID)
+			}
+
+			if _, ok := names[spec.Name]; ok {
+				return nil, fmt.Errorf("duplicate cluster name %q", spec.Name)
+			}
+
+			ids[spec.ID], names[spec.Name] = struct{}{}, struct{}{}
+			specs = append(specs, spec)
+		}
+	}
+
+	return specs, nil
+}
+
+func (spec clusterSpec) validate() error {
+	if spec.ID == cmtypes.ClusterIDMin || spec.ID > cmtypes.ClusterIDExt511 {
+		return fmt.Errorf("invalid cluster ID %d: must be in range %d..%d",
+			spec.ID, cmtypes.ClusterIDMin+1, cmtypes.ClusterIDExt511)
+	}
+
+	if err := cmtypes.ValidateClusterName(spec.Name); err != nil {
+		return fmt.Errorf("invalid cluster name %q: %w", spec.Name, err)
+	}
+
+	if err := spec.IPFamily.validate(); err != nil {
+		return fmt.Errorf("cluster %q: %w", spec.Name, err)
+	}
+
+	if err := spec.Schedule.validate(); err != nil {
+		return fmt.Errorf("cluster %q: %w", spec.Name, err)
+	}
+
+	for _, fs := range spec.Faults {
+		if err := fs.validate(); err != nil {
+			return fmt.Errorf("cluster %q: %w", spec.Name, err)
+		}
+	}
+
+	if err := spec.ClusterConfig.validate(spec.ID); err != nil {
+		return fmt.Errorf("cluster %q: %w", spec.Name, err)
+	}
+
+	if err := spec.ServiceShape.validate(); err != nil {
+		return fmt.Errorf("cluster %q: %w", spec.Name, err)
+	}
+
+	if err := spec.IdentityShape.validate(); err != nil {
+		return fmt.Errorf("cluster %q: %w", spec.Name, err)
+	}
+
+	if err := spec.NodeReplacement.validate(); err != nil {
+		return fmt.Errorf("cluster %q: %w", spec.Name, err)
+	}
+
+	if err := spec.KeyRotation.validate(); err != nil {
+		return fmt.Errorf("cluster %q: %w", spec.Name, err)
+	}
+
+	for typ, res := range map[string]resource{
+		"nodes": spec.Nodes, "identities": spec.Identities,
+		"endpoints": spec.Endpoints, "services": spec.Services,
+		"serviceExports": spec.ServiceExports,
+	} {
+		if err := res.Profile.validate(); err != nil {
+			return fmt.Errorf("cluster %q, %s: %w", spec.Name, typ, err)
+		}
+	}
+
+	return nil
+}
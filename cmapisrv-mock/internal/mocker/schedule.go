@@ -0,0 +1,99 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cilium/cilium/pkg/logging/logfields"
+)
+
+// schedule configures when a cluster joins and leaves the mesh. All instants
+// are relative to the moment the mocker started.
+type schedule struct {
+	// ConnectAfter is the delay after which the cluster connects (it is
+	// connected from the beginning if zero).
+	ConnectAfter duration `json:"connectAfter"`
+	// DisconnectAfter is the delay after which the cluster disconnects
+	// (it never disconnects if zero).
+	DisconnectAfter duration `json:"disconnectAfter"`
+	// Period, if set, causes the connect/disconnect cycle to repeat
+	// indefinitely, with the given period.
+	Period duration `json:"period"`
+}
+
+func (s schedule) validate() error {
+	if s.ConnectAfter < 0 || s.DisconnectAfter < 0 || s.Period < 0 {
+		return errors.New("schedule: durations must not be negative")
+	}
+
+	if s.DisconnectAfter != 0 && s.DisconnectAfter <= s.ConnectAfter {
+		return errors.New("schedule: disconnectAfter must be greater than connectAfter")
+	}
+
+	if s.Period != 0 {
+		if s.DisconnectAfter == 0 {
+			return errors.New("schedule: disconnectAfter must be set when period is set")
+		}
+
+		if s.DisconnectAfter >= s.ConnectAfter+s.Period {
+			return errors.New("schedule: the cluster must disconnect before connecting again")
+		}
+	}
+
+	return nil
+}
+
+// enabled returns whether the cluster ever connects or disconnects after startup.
+func (s schedule) enabled() bool {
+	return s.ConnectAfter != 0 || s.DisconnectAfter != 0
+}
+
+// schedule connects and disconnects the given cluster according to its schedule,
+// until the context is canceled.
+func (cls *clusters) schedule(ctx context.Context, spec clusterSpec) {
+	var (
+		log   = cls.log.With("cluster", spec.Name)
+		start = time.Now()
+		sched = spec.Schedule
+	)
+
+	wait := func(after duration) bool {
+		timer := time.NewTimer(time.Until(start.Add(time.Duration(after))))
+		defer timer.Stop()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-timer.C:
+			return true
+		}
+	}
+
+	for offset := duration(0); ; offset += sched.Period {
+		if sched.ConnectAfter != 0 || offset != 0 {
+			if !wait(offset + sched.ConnectAfter) {
+				return
+			}
+
+			if err := cls.Connect(spec.Name); err != nil {
+				log.Warn("Failed to connect cluster according to schedule", logfields.Error, err)
+			}
+		}
+
+		if sched.DisconnectAfter == 0 || !wait(offset+sched.DisconnectAfter) {
+			return
+		}
+
+		if err := cls.Disconnect(ctx, spec.Name); err != nil && ctx.Err() == nil {
+			log.Warn("Failed to disconnect cluster according to schedule", logfields.Error, err)
+		}
+
+		if sched.Period == 0 {
+			return
+		}
+	}
+}
@@ -4,48 +4,95 @@
 package mocker
 
 import (
+	"context"
 	"log/slog"
 	"maps"
+	"math"
 	"slices"
 
-	"k8s.io/utils/ptr"
-
 	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
 	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
-	"github.com/cilium/cilium/pkg/kvstore"
-	"github.com/cilium/cilium/pkg/loadbalancer"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/lock"
 )
 
 type services struct {
 	syncer[*serviceStore.ClusterService]
 
-	cluster    cmtypes.ClusterInfo
-	cache      cache[*serviceStore.ClusterService]
-	rnd        *random
-	enableIPv6 bool
+	cluster cmtypes.ClusterInfo
+	cache   cache[*serviceStore.ClusterService]
+	rnd     *random
+	shape   serviceShape
+	family  ipFamily
+	mu      lock.Mutex
+
+	// meanBackends is the mean number of backends per service, computed
+	// once as possibly expensive, depending on the distribution.
+	meanBackends float64
+
+	// endpoints, if set, are the endpoints the backends are selected from.
+	endpoints *endpoints
+	// pods, if set, drive the backends of the services, each selecting the
+	// pods of a given workload.
+	pods *pods
 }
 
-func newServices(log *slog.Logger, cp cparams) *services {
-	prefix := kvstore.StateToCachePrefix(serviceStore.ServiceStorePrefix)
-	ss := cp.factory.NewSyncStore(cp.cluster.Name, cp.backend, prefix)
+func newServicesStore(cp cparams) store.SyncStore {
+	prefix := cp.layout.prefix(serviceStore.ServiceStorePrefix)
+	return cp.newSyncStore("services", prefix)
+}
 
+func newServices(log *slog.Logger, cp cparams) *services {
+	ss := newServicesStore(cp)
 	svc := &services{
-		cluster:    cp.cluster,
-		cache:      newCache[*serviceStore.ClusterService](),
-		rnd:        cp.rnd,
-		enableIPv6: cp.enableIPv6,
+		cluster: cp.cluster,
+		cache:   newCompactCache(cp.serviceCodec()),
+		rnd:     cp.random("services"),
+		shape:   cp.spec.ServiceShape,
+		family:  cp.family,
+
+		meanBackends: cp.spec.ServiceShape.Backends.mean(),
 	}
 
-	svc.syncer = newSyncer(log, "services", ss, svc.next)
+	svc.syncer = newSyncer(log, "services", ss, svc.next,
+		newControl(cp.spec.Services, svc.cache.Len),
+		cp.metrics.resource(cp.cluster.Name, "services"), cp.errors)
 	return svc
 }
 
-func (svc *services) next(synced bool, target uint) (obj *serviceStore.ClusterService, delete bool) {
-	if synced && svc.rnd.ShouldUpdateLikely() && svc.cache.Len() > 0 {
-		service := svc.cache.Get(svc.rnd)
-		service.Backends = svc.updated(service.Backends)
-		svc.cache.Upsert(service)
-		return service, false
+// withBackendsFrom configures the services to select the backends among the
+// given endpoints, rather than generating random addresses.
+func (svc *services) withBackendsFrom(eps *endpoints) {
+	svc.endpoints = eps
+	svc.syncer.mu = &svc.mu
+}
+
+// RemoveBackend removes the given backend from all the services selecting
+// it. It must be called after removing the corresponding endpoint from the
+// cache, and before deleting it from the kvstore.
+func (svc *services) RemoveBackend(ctx context.Context, ip string) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	for _, service := range svc.cache.Select(func(cs *serviceStore.ClusterService) bool { return cs.Backends[ip] != nil }) {
+		updated := *service
+		updated.Backends = maps.Clone(service.Backends)
+		delete(updated.Backends, ip)
+
+		svc.cache.Upsert(&updated)
+		svc.do(ctx, &updated, false)
+	}
+}
+
+func (svc *services) next(_ context.Context, synced bool, target uint) (obj *serviceStore.ClusterService, delete bool) {
+	if svc.pods == nil && synced && svc.rnd.ShouldUpdateLikely() {
+		if cached, ok := svc.cache.Get(svc.rnd); ok {
+			// Copy the service, as the cached one may be concurrently marshaled.
+			service := *cached
+			service.Backends = svc.updated(maps.Clone(service.Backends))
+			svc.cache.Upsert(&service)
+			return &service, false
+		}
 	}
 
 	if synced && svc.rnd.ShouldRemove(svc.cache.Len(), target) && svc.cache.Len() > 1 {
@@ -53,7 +100,13 @@ func (svc *services) next(synced bool, target uint) (obj *serviceStore.ClusterSe
 	}
 
 	for {
-		service := svc.new()
+		var service *serviceStore.ClusterService
+		if svc.pods != nil {
+			service = svc.newForPods()
+		} else {
+			service = svc.new()
+		}
+
 		if svc.cache.Add(service) {
 			return service, false
 		}
@@ -62,6 +115,7 @@ func (svc *services) next(synced bool, target uint) (obj *serviceStore.ClusterSe
 
 func (svc *services) new() *serviceStore.ClusterService {
 	lbls := svc.rnd.ServiceLabels()
+	shared, includeExternal := svc.shape.Mix.sample(svc.rnd)
 	return &serviceStore.ClusterService{
 		Cluster:         svc.cluster.Name,
 		ClusterID:       svc.cluster.ID,
@@ -71,20 +125,19 @@ func (svc *services) new() *serviceStore.ClusterService {
 		Name:            svc.rnd.Name(),
 		Frontends:       svc.frontends(),
 		Backends:        svc.backends(),
-		Shared:          true,
-		IncludeExternal: true,
+		Shared:          shared,
+		IncludeExternal: includeExternal,
 	}
 }
 
 func (svc *services) frontends() map[string]serviceStore.PortConfiguration {
 	fe := make(map[string]serviceStore.PortConfiguration)
-	ports := serviceStore.PortConfiguration{
-		"foo": ptr.To(loadbalancer.NewL4Addr(loadbalancer.TCP, 80)),
-		"bar": ptr.To(loadbalancer.NewL4Addr(loadbalancer.TCP, 90)),
-	}
+	ports := svc.shape.frontendPorts()
 
-	fe[svc.rnd.ServiceIP4().String()] = ports
-	if svc.enableIPv6 {
+	if svc.family.ipv4() {
+		fe[svc.rnd.ServiceIP4().String()] = ports
+	}
+	if svc.family.ipv6() {
 		fe[svc.rnd.ServiceIP6().String()] = ports
 	}
 
@@ -92,20 +145,25 @@ func (svc *services) frontends() map[string]serviceStore.PortConfiguration {
 }
 
 func (svc *services) backends() map[string]serviceStore.PortConfiguration {
-	n := svc.rnd.ServiceBackends()
-	if svc.enableIPv6 {
-		n *= 2
+	n := svc.shape.Backends.sample(svc.rnd)
+	if svc.endpoints != nil {
+		be := make(map[string]serviceStore.PortConfiguration, n)
+		for _, endpoint := range svc.endpoints.cache.Sample(svc.rnd, n) {
+			be[endpoint.IP.String()] = svc.shape.backendPorts()
+		}
+		return be
 	}
 
+	n *= svc.family.count()
+
 	be := make(map[string]serviceStore.PortConfiguration, n)
-	ports := serviceStore.PortConfiguration{
-		"foo": ptr.To(loadbalancer.NewL4Addr(loadbalancer.TCP, 8080)),
-		"bar": ptr.To(loadbalancer.NewL4Addr(loadbalancer.TCP, 9090)),
-	}
+	ports := svc.shape.backendPorts()
 
-	for len(be) < n {
-		be[svc.rnd.PodIP4().String()] = ports
-		if svc.enableIPv6 {
+	for uint(len(be)) < n {
+		if svc.family.ipv4() {
+			be[svc.rnd.PodIP4().String()] = ports
+		}
+		if svc.family.ipv6() {
 			be[svc.rnd.PodIP6().String()] = ports
 		}
 	}
@@ -114,19 +172,31 @@ func (svc *services) backends() map[string]serviceStore.PortConfiguration {
 }
 
 func (svc *services) updated(be map[string]serviceStore.PortConfiguration) map[string]serviceStore.PortConfiguration {
-	if svc.rnd.ShouldRemove(uint(len(be)), uint(MaxServiceBackends/2)) && len(be) > 0 {
-		key := slices.Collect(maps.Keys(be))[svc.rnd.Index(len(be))]
+	target := uint(math.Round(svc.meanBackends))
+	if svc.endpoints == nil {
+		target *= svc.family.count()
+	}
+
+	// Subsequent updates cause the number of backends to fluctuate around
+	// the mean of the configured distribution.
+	if svc.rnd.ShouldRemove(uint(len(be)), target) && len(be) > 0 {
+		key := slices.Sorted(maps.Keys(be))[svc.rnd.Index(len(be))]
 		delete(be, key)
 		return be
 	}
 
-	ports := serviceStore.PortConfiguration{
-		"foo": ptr.To(loadbalancer.NewL4Addr(loadbalancer.TCP, 8080)),
-		"bar": ptr.To(loadbalancer.NewL4Addr(loadbalancer.TCP, 9090)),
+	ports := svc.shape.backendPorts()
+	if svc.endpoints != nil {
+		if endpoint, ok := svc.endpoints.cache.Get(svc.rnd); ok {
+			be[endpoint.IP.String()] = ports
+		}
+		return be
 	}
 
-	be[svc.rnd.PodIP4().String()] = ports
-	if svc.enableIPv6 {
+	if svc.family.ipv4() {
+		be[svc.rnd.PodIP4().String()] = ports
+	}
+	if svc.family.ipv6() {
 		be[svc.rnd.PodIP6().String()] = ports
 	}
 
@@ -0,0 +1,159 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"path"
+	"slices"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
+	cmtypes "github.com/cilium/cilium/pkg/clustermesh/types"
+	"github.com/cilium/cilium/pkg/kvstore"
+	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/lock"
+)
+
+// github.com/cilium/cilium/pkg/clustermesh/mcsapi/types.ServiceExportStorePrefix
+var ServiceExportStorePrefix = path.Join(kvstore.BaseKeyPrefix, "state", "serviceexports", "v1")
+
+// serviceExport mirrors github.com/cilium/cilium/pkg/clustermesh/mcsapi/types.MCSAPIServiceSpec,
+// which is not vendored to avoid depending on the MCS-API types.
+type serviceExport struct {
+	Cluster                 string            `json:"cluster"`
+	Name                    string            `json:"name"`
+	Namespace               string            `json:"namespace"`
+	ExportCreationTimestamp metav1.Time       `json:"exportCreationTimestamp"`
+	Ports                   []exportPort      `json:"ports"`
+	Type                    string            `json:"type"`
+	SessionAffinity         string            `json:"sessionAffinity"`
+	Annotations             map[string]string `json:"annotations,omitempty"`
+	Labels                  map[string]string `json:"labels,omitempty"`
+}
+
+// exportPort mirrors sigs.k8s.io/mcs-api/pkg/apis/v1alpha1.ServicePort.
+type exportPort struct {
+	Name     string `json:"name,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	Port     int32  `json:"port"`
+}
+
+func (se *serviceExport) GetKeyName() string {
+	return path.Join(se.Cluster, se.Namespace, se.Name)
+}
+
+func (se *serviceExport) Marshal() ([]byte, error) {
+	return json.Marshal(se)
+}
+
+func (se *serviceExport) Unmarshal(_ string, data []byte) error {
+	return json.Unmarshal(data, se)
+}
+
+type serviceExports struct {
+	syncer[*serviceExport]
+
+	cluster  cmtypes.ClusterInfo
+	cache    cache[*serviceExport]
+	rnd      *random
+	services *services
+	mu       lock.Mutex
+}
+
+func newServiceExportsStore(cp cparams) store.SyncStore {
+	prefix := cp.layout.prefix(ServiceExportStorePrefix)
+	return cp.newSyncStore("serviceexports", prefix)
+}
+
+func newServiceExports(log *slog.Logger, cp cparams, services *services) *serviceExports {
+	ss := newServiceExportsStore(cp)
+	exp := &serviceExports{
+		cluster:  cp.cluster,
+		cache:    newCache[*serviceExport](),
+		rnd:      cp.random("serviceexports"),
+		services: services,
+	}
+
+	exp.syncer = newSyncer(log, "serviceexports", ss, exp.next,
+		newControl(cp.spec.ServiceExports, exp.cache.Len),
+		cp.metrics.resource(cp.cluster.Name, "serviceexports"), cp.errors)
+	exp.syncer.mu = &exp.mu
+	return exp
+}
+
+// exportsEnabled returns whether service exports are mocked for the given cluster,
+// hence whether the corresponding capability shall be advertised.
+func (spec clusterSpec) exportsEnabled() bool {
+	return spec.ServiceExports.Target > 0 || spec.ServiceExports.QPS > 0
+}
+
+// RemoveFor removes the export of the given service, if any. It must be called
+// after removing the service from the corresponding cache, and before deleting
+// it from the kvstore.
+func (exp *serviceExports) RemoveFor(ctx context.Context, service *serviceStore.ClusterService) {
+	exp.mu.Lock()
+	defer exp.mu.Unlock()
+
+	export, ok := exp.cache.Lookup(service.GetKeyName())
+	if !ok {
+		return
+	}
+
+	exp.cache.Delete(export.GetKeyName())
+	exp.do(ctx, export, true)
+}
+
+// next returns a nil export if there is no global service left to be exported.
+func (exp *serviceExports) next(_ context.Context, synced bool, target uint) (obj *serviceExport, delete bool) {
+	if synced && exp.rnd.ShouldRemove(exp.cache.Len(), target) && exp.cache.Len() > 1 {
+		return exp.cache.Remove(exp.rnd), true
+	}
+
+	candidates := exp.services.cache.Select(func(cs *serviceStore.ClusterService) bool {
+		_, exported := exp.cache.Lookup(cs.GetKeyName())
+		return cs.IncludeExternal && !exported
+	})
+
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	// Sort the candidates, as the order of the cached services depends on
+	// the interleaving of the operations, for reproducibility.
+	slices.SortFunc(candidates, func(a, b *serviceStore.ClusterService) int {
+		return cmp.Compare(a.GetKeyName(), b.GetKeyName())
+	})
+
+	export := exp.new(candidates[exp.rnd.Index(len(candidates))])
+	exp.cache.Add(export)
+	return export, false
+}
+
+func (exp *serviceExports) new(service *serviceStore.ClusterService) *serviceExport {
+	export := &serviceExport{
+		Cluster:                 exp.cluster.Name,
+		Name:                    service.Name,
+		Namespace:               service.Namespace,
+		ExportCreationTimestamp: metav1.Now(),
+		Ports:                   []exportPort{},
+		Type:                    "ClusterSetIP",
+		SessionAffinity:         "None",
+	}
+
+	// All frontends share the same port configuration.
+	for _, ports := range service.Frontends {
+		for name, port := range ports {
+			export.Ports = append(export.Ports, exportPort{Name: name, Protocol: port.Protocol, Port: int32(port.Port)})
+		}
+		break
+	}
+
+	slices.SortFunc(export.Ports, func(a, b exportPort) int { return cmp.Compare(a.Name, b.Name) })
+	return export
+}
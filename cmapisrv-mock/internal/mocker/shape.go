@@ -0,0 +1,307 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package mocker
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+
+	"k8s.io/utils/ptr"
+
+	serviceStore "github.com/cilium/cilium/pkg/clustermesh/store"
+	"github.com/cilium/cilium/pkg/loadbalancer"
+)
+
+// serviceShape configures the shape of the mocked services.
+type serviceShape struct {
+	// Ports are the ports exposed by each service.
+	Ports []servicePort `json:"ports"`
+	// Backends is the distribution of the number of backends of each service.
+	Backends distribution `json:"backends"`
+	// Mix configures the relative weights of the different kinds of services.
+	Mix serviceMix `json:"mix"`
+}
+
+type servicePort struct {
+	Name     string              `json:"name"`
+	Protocol loadbalancer.L4Type `json:"protocol"`
+	// Port is the frontend port.
+	Port uint16 `json:"port"`
+	// TargetPort is the backend port (defaults to the frontend one).
+	TargetPort uint16 `json:"targetPort"`
+}
+
+type distributionType string
+
+const (
+	distributionFixed    = distributionType("fixed")
+	distributionUniform  = distributionType("uniform")
+	distributionZipf     = distributionType("zipf")
+	distributionWeighted = distributionType("weighted")
+)
+
+// distribution is a probability distribution over non-negative integers.
+type distribution struct {
+	// Type is the type of the distribution (fixed|uniform|zipf|weighted).
+	Type distributionType `json:"type"`
+	// Count is the value of a fixed distribution.
+	Count uint `json:"count"`
+	// Min and Max bound the values of uniform and zipf distributions (inclusive).
+	// Min is also the first value of a weighted distribution.
+	Min uint `json:"min"`
+	Max uint `json:"max"`
+	// Exponent is the exponent (greater than one) of a zipf distribution,
+	// with higher values corresponding to shorter tails.
+	Exponent float64 `json:"exponent"`
+	// Weights are the relative weights of the values of a weighted
+	// distribution, starting from Min.
+	Weights []float64 `json:"weights"`
+}
+
+// serviceMix configures the relative weights of shared global services,
+// non-shared global services (i.e., which only include remote backends)
+// and non-global services.
+type serviceMix struct {
+	Shared    float64 `json:"shared"`
+	NonShared float64 `json:"nonShared"`
+	NonGlobal float64 `json:"nonGlobal"`
+}
+
+// identityShape configures the labels of the mocked identities, and the
+// namespaces the mocked objects belong to.
+type identityShape struct {
+	// Namespaces is the size of the pool of namespaces, shared by identities,
+	// endpoints and services (unbounded if zero).
+	Namespaces uint `json:"namespaces"`
+	// ServiceAccounts is the size of the pool of service accounts (unbounded
+	// if zero).
+	ServiceAccounts uint `json:"serviceAccounts"`
+	// Labels is the distribution of the number of labels of each identity,
+	// in addition to the namespace, service account and cluster ones.
+	Labels distribution `json:"labels"`
+	// Catalog is the set of labels the identity labels are selected from. Random
+	// labels are generated if empty.
+	Catalog []catalogLabel `json:"catalog"`
+}
+
+// catalogLabel is a label key, with the possible values. Each identity includes
+// at most one value for each key, and keys are selected with probability
+// proportional to their weight (defaults to one).
+type catalogLabel struct {
+	Key    string   `json:"key"`
+	Values []string `json:"values"`
+	Weight float64  `json:"weight"`
+}
+
+var defaultServiceShape = serviceShape{
+	Ports: []servicePort{
+		{Name: "foo", Protocol: loadbalancer.TCP, Port: 80, TargetPort: 8080},
+		{Name: "bar", Protocol: loadbalancer.TCP, Port: 90, TargetPort: 9090},
+	},
+	Backends: distribution{Type: distributionUniform, Min: 0, Max: MaxServiceBackends - 1},
+	Mix:      serviceMix{Shared: 1},
+}
+
+var defaultIdentityShape = identityShape{
+	// No additional labels with probability 3/8, and between one and five
+	// with probability 1/8 each, so that the results remain comparable with
+	// the ones obtained before the shape was configurable.
+	Labels: distribution{Type: distributionWeighted, Weights: []float64{3, 1, 1, 1, 1, 1}},
+}
+
+// resolve returns the shape obtained overriding the given one with the
+// settings explicitly configured.
+func (ss serviceShape) resolve(def serviceShape) serviceShape {
+	if len(ss.Ports) > 0 {
+		def.Ports = ss.Ports
+	}
+
+	if ss.Backends.Type != "" {
+		def.Backends = ss.Backends
+	}
+
+	if ss.Mix != (serviceMix{}) {
+		def.Mix = ss.Mix
+	}
+
+	return def
+}
+
+func (ss serviceShape) validate() error {
+	if len(ss.Ports) == 0 {
+		return errors.New("service shape: at least one port must be specified")
+	}
+
+	names := make(map[string]struct{})
+	for _, port := range ss.Ports {
+		if _, ok := names[port.Name]; ok || port.Name == "" {
+			return fmt.Errorf("service shape: port names must be non-empty and unique, got %q", port.Name)
+		}
+		names[port.Name] = struct{}{}
+
+		switch port.Protocol {
+		case loadbalancer.TCP, loadbalancer.UDP, loadbalancer.SCTP:
+		default:
+			return fmt.Errorf("service shape: port %q: unsupported protocol %q; must be one of TCP|UDP|SCTP", port.Name, port.Protocol)
+		}
+
+		if port.Port == 0 {
+			return fmt.Errorf("service shape: port %q: port must be specified", port.Name)
+		}
+	}
+
+	if err := ss.Backends.validate(); err != nil {
+		return fmt.Errorf("service shape: backends: %w", err)
+	}
+
+	if ss.Mix.Shared < 0 || ss.Mix.NonShared < 0 || ss.Mix.NonGlobal < 0 ||
+		ss.Mix.Shared+ss.Mix.NonShared+ss.Mix.NonGlobal == 0 {
+		return errors.New("service shape: mix weights must not be negative, and at least one must be positive")
+	}
+
+	return nil
+}
+
+// sample returns the Shared and IncludeExternal settings of a random service.
+func (m serviceMix) sample(rnd *random) (shared, includeExternal bool) {
+	switch rnd.Weighted(m.Shared, m.NonShared, m.NonGlobal) {
+	case 0:
+		return true, true
+	case 1:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// frontendPorts returns the frontend port configuration.
+func (ss serviceShape) frontendPorts() serviceStore.PortConfiguration {
+	ports := make(serviceStore.PortConfiguration, len(ss.Ports))
+	for _, port := range ss.Ports {
+		ports[port.Name] = ptr.To(loadbalancer.NewL4Addr(port.Protocol, port.Port))
+	}
+	return ports
+}
+
+// backendPorts returns the backend port configuration.
+func (ss serviceShape) backendPorts() serviceStore.PortConfiguration {
+	ports := make(serviceStore.PortConfiguration, len(ss.Ports))
+	for _, port := range ss.Ports {
+		ports[port.Name] = ptr.To(loadbalancer.NewL4Addr(port.Protocol, cmp.Or(port.TargetPort, port.Port)))
+	}
+	return ports
+}
+
+// resolve returns the shape obtained overriding the given one with the
+// settings explicitly configured.
+func (is identityShape) resolve(def identityShape) identityShape {
+	def.Namespaces = cmp.Or(is.Namespaces, def.Namespaces)
+	def.ServiceAccounts = cmp.Or(is.ServiceAccounts, def.ServiceAccounts)
+
+	if is.Labels.Type != "" {
+		def.Labels = is.Labels
+	}
+
+	if len(is.Catalog) > 0 {
+		def.Catalog = is.Catalog
+	}
+
+	return def
+}
+
+func (is identityShape) validate() error {
+	if err := is.Labels.validate(); err != nil {
+		return fmt.Errorf("identity shape: labels: %w", err)
+	}
+
+	keys := make(map[string]struct{})
+	for _, lbl := range is.Catalog {
+		if _, ok := keys[lbl.Key]; ok || lbl.Key == "" {
+			return fmt.Errorf("identity shape: catalog keys must be non-empty and unique, got %q", lbl.Key)
+		}
+		keys[lbl.Key] = struct{}{}
+
+		if len(lbl.Values) == 0 {
+			return fmt.Errorf("identity shape: catalog key %q: at least one value must be specified", lbl.Key)
+		}
+
+		if lbl.Weight < 0 {
+			return fmt.Errorf("identity shape: catalog key %q: weight must not be negative", lbl.Key)
+		}
+	}
+
+	return nil
+}
+
+func (d distribution) validate() error {
+	switch d.Type {
+	case distributionFixed:
+	case distributionUniform:
+		if d.Max < d.Min {
+			return errors.New("uniform distribution: max must not be lower than min")
+		}
+	case distributionZipf:
+		if d.Max <= d.Min {
+			return errors.New("zipf distribution: max must be greater than min")
+		}
+		if d.Exponent <= 1 {
+			return errors.New("zipf distribution: exponent must be greater than one")
+		}
+	case distributionWeighted:
+		var total float64
+		for _, w := range d.Weights {
+			if w < 0 {
+				return errors.New("weighted distribution: weights must not be negative")
+			}
+			total += w
+		}
+		if total == 0 {
+			return errors.New("weighted distribution: at least one weight must be positive")
+		}
+	default:
+		return fmt.Errorf("unsupported distribution type %q; must be one of fixed|uniform|zipf|weighted", d.Type)
+	}
+
+	return nil
+}
+
+// sample returns a random value drawn from the distribution.
+func (d distribution) sample(rnd *random) uint {
+	switch d.Type {
+	case distributionUniform:
+		return d.Min + uint(rnd.intn(int(d.Max-d.Min+1)))
+	case distributionZipf:
+		return d.Min + uint(rnd.zipf(d.Exponent, uint64(d.Max-d.Min)))
+	case distributionWeighted:
+		return d.Min + uint(rnd.Weighted(d.Weights...))
+	default:
+		return d.Count
+	}
+}
+
+// mean returns the expected value of the distribution.
+func (d distribution) mean() float64 {
+	switch d.Type {
+	case distributionUniform:
+		return float64(d.Min+d.Max) / 2
+	case distributionZipf:
+		// P(k) is proportional to (1+k)^-s, for k in [0, max-min].
+		var sum, weighted float64
+		for k := range d.Max - d.Min + 1 {
+			p := math.Pow(float64(1+k), -d.Exponent)
+			sum, weighted = sum+p, weighted+p*float64(k)
+		}
+		return float64(d.Min) + weighted/sum
+	case distributionWeighted:
+		var sum, weighted float64
+		for k, w := range d.Weights {
+			sum, weighted = sum+w, weighted+w*float64(k)
+		}
+		return float64(d.Min) + weighted/sum
+	default:
+		return float64(d.Count)
+	}
+}
@@ -6,49 +6,72 @@ package mocker
 import (
 	"context"
 	"log/slog"
-	"os"
+	"math"
 	"sync"
+	"time"
 
 	"golang.org/x/time/rate"
 
 	"github.com/cilium/cilium/pkg/kvstore/store"
+	"github.com/cilium/cilium/pkg/lock"
 	"github.com/cilium/cilium/pkg/logging/logfields"
 )
 
-type nextFn[T store.Key] func(synced bool, target uint) (obj T, delete bool)
+// nextFn returns the next object to be upserted or deleted. A nil object is
+// returned if none can be currently generated, e.g., as derived from objects
+// of a different type, or if the operations have already been performed, e.g.,
+// as involving objects of different types which must be written in order.
+type nextFn[T store.Key] func(ctx context.Context, synced bool, target uint) (obj T, delete bool)
 
 type syncer[T store.Key] struct {
-	log   *slog.Logger
-	store store.SyncStore
-	next  nextFn[T]
-	init  chan struct{}
+	log     *slog.Logger
+	store   store.SyncStore
+	next    nextFn[T]
+	init    chan struct{}
+	ctrl    *control
+	metrics resourceMetrics
+
+	// mu, if set, is held while generating and performing each operation,
+	// to serialize them with the ones triggered by other resources.
+	mu *lock.Mutex
+	// errors tracks the failed operations.
+	errors *errorTracker
+	// onDelete, if set, is invoked before deleting each object.
+	onDelete func(ctx context.Context, obj T)
+	// onDeleted, if set, is invoked after deleting each object.
+	onDeleted func(ctx context.Context, obj T)
+	// waitFor, if set, is waited for before marking the initial synchronization
+	// as completed, as the objects may be also written on behalf of other types.
+	waitFor func(ctx context.Context) error
+	// initial, if set, are the objects written during the initial
+	// synchronization, in place of target random ones. They must be
+	// already present in the cache.
+	initial []T
 }
 
-func newSyncer[T store.Key](log *slog.Logger, typ string, store store.SyncStore, next nextFn[T]) syncer[T] {
+func newSyncer[T store.Key](log *slog.Logger, typ string, store store.SyncStore, next nextFn[T], ctrl *control, metrics resourceMetrics, errors *errorTracker) syncer[T] {
 	return syncer[T]{
-		log:   log.With("type", typ),
-		store: store,
-		next:  next,
-		init:  make(chan struct{}),
+		log:     log.With("type", typ),
+		store:   store,
+		next:    next,
+		init:    make(chan struct{}),
+		ctrl:    ctrl,
+		metrics: metrics,
+		errors:  errors,
 	}
 }
 
-func (s syncer[T]) Run(ctx context.Context, target uint, qps rate.Limit, allSynced <-chan struct{}) {
+func (s syncer[T]) Run(ctx context.Context, allSynced <-chan struct{}) {
 	s.log.Info("Starting synchronization")
-	do := func(obj T, delete bool) {
-		if delete {
-			s.log.Debug("Deleting key", "key", obj.GetKeyName())
-			if err := s.store.DeleteKey(ctx, obj); err != nil {
-				s.log.Error("Failed to delete key", logfields.Error, err)
-				os.Exit(-1)
-			}
-			return
+	step := func(synced bool, target uint) {
+		if s.mu != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
 		}
 
-		s.log.Debug("Upserting key", "key", obj.GetKeyName())
-		if err := s.store.UpsertKey(ctx, obj); err != nil {
-			s.log.Error("Failed to upsert key", logfields.Error, err)
-			os.Exit(-1)
+		obj, delete := s.next(ctx, synced, target)
+		if any(obj) != any(*new(T)) {
+			s.do(ctx, obj, delete)
 		}
 	}
 
@@ -59,8 +82,19 @@ func (s syncer[T]) Run(ctx context.Context, target uint, qps rate.Limit, allSync
 		wg.Done()
 	}()
 
-	for i := uint(0); i < target; i++ {
-		do(s.next(false, target))
+	if s.initial != nil {
+		for _, obj := range s.initial {
+			s.do(ctx, obj, false)
+		}
+	} else {
+		target := s.ctrl.state().target
+		for i := uint(0); i < target; i++ {
+			step(false, target)
+		}
+	}
+
+	if s.waitFor != nil && s.waitFor(ctx) != nil {
+		return
 	}
 
 	s.store.Synced(ctx, func(context.Context) {
@@ -77,17 +111,103 @@ func (s syncer[T]) Run(ctx context.Context, target uint, qps rate.Limit, allSync
 		// consuming rate limiter slots before turning ready.
 	}
 
-	rl := rate.NewLimiter(qps, 1)
+	defer func() {
+		wg.Wait()
+		s.log.Info("Ending synchronization")
+	}()
+
+	s.ctrl.start()
+	if s.ctrl.passive {
+		<-ctx.Done()
+		return
+	}
+
+	rl := rate.NewLimiter(0, 1)
 	for {
-		if err := rl.Wait(ctx); err != nil {
-			wg.Wait()
-			s.log.Info("Ending synchronization")
+		// The target and the QPS can be tuned at run-time, hence make sure
+		// to stop waiting and start over as soon as they get modified. The
+		// QPS is additionally periodically recomputed if modulated by a
+		// time-varying churn profile.
+		var (
+			st     = s.ctrl.state()
+			active = !st.paused && st.target > 0 && st.qps > 0
+			rsv    *rate.Reservation
+			delay  = time.Duration(math.MaxInt64)
+		)
+
+		if active {
+			rl.SetLimit(st.qps)
+			rsv = rl.Reserve()
+			delay = rsv.Delay()
+			s.metrics.qps.Set(float64(st.qps))
+		} else {
+			s.metrics.qps.Set(0)
+		}
+
+		wait := delay
+		if st.dynamic {
+			wait = min(wait, profileResolution)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			cancelReservation(rsv)
 			return
+		case <-st.changed:
+			timer.Stop()
+			cancelReservation(rsv)
+			continue
+		case <-timer.C:
+		}
+
+		if wait < delay {
+			cancelReservation(rsv)
+			continue
+		}
+
+		s.metrics.waiting.Observe(delay.Seconds())
+		if !s.ctrl.step(func() { step(true, st.target) }) {
+			// The churn got paused or held in the meanwhile.
+			cancelReservation(rsv)
+		}
+	}
+}
+
+func (s syncer[T]) do(ctx context.Context, obj T, delete bool) {
+	if delete && s.onDelete != nil {
+		s.onDelete(ctx, obj)
+	}
+
+	defer func() { s.metrics.objects.Set(float64(s.ctrl.size())) }()
+
+	// The sync store only returns errors which cannot be recovered from by
+	// retrying (e.g., marshaling failures), while it transparently retries
+	// the failed kvstore operations.
+	if delete {
+		s.log.Debug("Deleting key", "key", obj.GetKeyName())
+		if err := s.store.DeleteKey(ctx, obj); err != nil {
+			s.log.Error("Failed to delete key", logfields.Error, err)
+			s.errors.failed(operationDelete, err)
 		}
 
-		if target != 0 && qps > 0 {
-			do(s.next(true, target))
+		if s.onDeleted != nil {
+			s.onDeleted(ctx, obj)
 		}
+		return
+	}
+
+	s.log.Debug("Upserting key", "key", obj.GetKeyName())
+	if err := s.store.UpsertKey(ctx, obj); err != nil {
+		s.log.Error("Failed to upsert key", logfields.Error, err)
+		s.errors.failed(operationUpsert, err)
+	}
+}
+
+func cancelReservation(rsv *rate.Reservation) {
+	if rsv != nil {
+		rsv.Cancel()
 	}
 }
 
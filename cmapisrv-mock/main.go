@@ -26,7 +26,8 @@ func main() {
 
 	cmd.AddCommand(
 		etcdinit.NewCmd(),
-		newMockerCmd(hive.New(mocker.Cell)),
+		newHiveCmd("mocker", "Run ClusterMesh mocker", hive.New(mocker.Cell)),
+		newHiveCmd("record", "Record the kvstore traffic, to replay it through the mocker", hive.New(mocker.RecorderCell)),
 	)
 
 	if err := cmd.Execute(); err != nil {
@@ -35,10 +36,10 @@ func main() {
 	}
 }
 
-func newMockerCmd(h *hive.Hive) *cobra.Command {
+func newHiveCmd(use, short string, h *hive.Hive) *cobra.Command {
 	rootCmd := &cobra.Command{
-		Use:   "mocker",
-		Short: "Run ClusterMesh mocker",
+		Use:   use,
+		Short: short,
 		Run: func(cmd *cobra.Command, args []string) {
 			if err := h.Run(logging.DefaultSlogLogger); err != nil {
 				logging.DefaultSlogLogger.Error(err.Error())
@@ -47,9 +48,9 @@ func newMockerCmd(h *hive.Hive) *cobra.Command {
 		},
 		PreRun: func(cmd *cobra.Command, args []string) {
 			metrics.Namespace = "mocker"
-			option.Config.SetupLogging(h.Viper(), "mocker")
+			option.Config.SetupLogging(h.Viper(), use)
 
-			logger := logging.DefaultSlogLogger.With(logfields.LogSubsys, "mocker")
+			logger := logging.DefaultSlogLogger.With(logfields.LogSubsys, use)
 			option.LogRegisteredSlogOptions(h.Viper(), logger)
 		},
 	}